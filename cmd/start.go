@@ -41,6 +41,10 @@ var startCmd = &cobra.Command{
 		}
 		runtime.GOMAXPROCS(config.GlobalConfig.Application.Processes)
 		log.Printf("%+v\n", config.GlobalConfig)
+		if http.IsMaster() {
+			http.StartMaster()
+			return
+		}
 		http.StartServer()
 	},
 }
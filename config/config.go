@@ -10,9 +10,44 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+// AdminConfig 管理接口配置
+type AdminConfig struct {
+	// Listen 管理接口监听地址,为空则不启用
+	Listen string
+	// Token 访问令牌,请求需携带 Authorization: Bearer <token>
+	Token string
+	// StateFile 节点列表与drain/disable状态持久化文件,为空则不持久化
+	// 重启后恢复管理接口添加、移除的节点与节点状态,配置中新增的节点保留,从配置删除的节点不再恢复
+	StateFile string `yaml:"state_file"`
+}
+
 // ApplicationConfig 应用配置
 type ApplicationConfig struct {
+	// Processes 每个进程的GOMAXPROCS
 	Processes int
+	// Workers 大于0时启用多进程模式,master进程启动并监管Workers个worker进程
+	// 连接数、并发数与限流由各worker独立计数
+	Workers int
+	Admin   AdminConfig
+	// CertExpiryWarnDays 证书剩余有效天数小于该值时告警
+	CertExpiryWarnDays int `yaml:"cert_expiry_warn_days"`
+	// UpgradeDrainTimeout 平滑升级(SIGUSR2)后旧进程等待进行中请求的最长时间/ms
+	UpgradeDrainTimeout int64 `yaml:"upgrade_drain_timeout"`
+}
+
+// UpstreamTLSConfig 后端服务TLS配置
+type UpstreamTLSConfig struct {
+	// Enable 使用HTTPS连接后端服务
+	Enable bool
+	// CA 校验后端证书的CA文件(PEM),为空使用系统CA
+	CA string
+	// ServerName 校验证书及SNI使用的域名,为空使用节点地址中的host,resolve解析得到的节点使用解析前的主机名
+	ServerName string `yaml:"server_name"`
+	// InsecureSkipVerify 跳过证书校验,仅用于开发环境
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+	// Cert/Key 客户端证书,后端要求mTLS时配置
+	Cert string
+	Key  string
 }
 
 // UpstreamConfig 后端服务配置
@@ -21,6 +56,72 @@ type UpstreamConfig struct {
 	Balance string
 	Timeout int64
 	Servers []string
+	// File 节点列表文件或目录(JSON/YAML),设置后忽略Servers并监听文件变更
+	File string
+	// Resolve 将主机名节点解析为全部A/AAAA记录,每个地址作为一个节点
+	Resolve bool
+	// ResolveInterval 重新解析间隔/ms
+	ResolveInterval int64 `yaml:"resolve_interval"`
+	// SRV 通过SRV记录发现节点,如 _http._tcp.example.com,只使用priority最小的一组记录
+	SRV string
+	TLS UpstreamTLSConfig
+	// ProxyProtocol 向节点发送PROXY协议头 v1|v2,启用后每个请求使用新连接
+	ProxyProtocol string `yaml:"proxy_protocol"`
+}
+
+// InterceptorConfig 拦截器配置,可只写名称,或 {name: access_log, args: {...}}
+type InterceptorConfig struct {
+	Name string
+	Args map[string]string
+}
+
+// UnmarshalYAML 支持以字符串形式只配置名称
+func (ic *InterceptorConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		ic.Name = name
+		return nil
+	}
+	type plain InterceptorConfig
+	return unmarshal((*plain)(ic))
+}
+
+// HandlerConfig 自定义处理器或处理器映射配置,可只写名称,或 {name: xx, args: {...}}
+type HandlerConfig struct {
+	Name string
+	Args map[string]string
+}
+
+// UnmarshalYAML 支持以字符串形式只配置名称
+func (hc *HandlerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		hc.Name = name
+		return nil
+	}
+	type plain HandlerConfig
+	return unmarshal((*plain)(hc))
+}
+
+// AuthRequestConfig 外部认证子请求配置,认证服务返回2xx时放行,401/403时将其响应返回客户端
+type AuthRequestConfig struct {
+	// Upstream 认证服务的后端服务组ID,为空则不启用
+	Upstream string
+	// Method 子请求方法,默认GET
+	Method string
+	// Path 子请求路径,可使用变量,默认 /
+	Path string
+	// Headers 复制到子请求的请求头,默认 Authorization 与 Cookie
+	Headers []string
+	// ResponseHeaders 认证通过时从认证响应复制到代理请求的头
+	ResponseHeaders []string `yaml:"response_headers"`
+	// Timeout 子请求超时/ms,默认使用后端服务组的超时
+	Timeout int64
+	// CacheTTL 认证结果缓存时间/ms,0则不缓存
+	CacheTTL int64 `yaml:"cache_ttl"`
+	// CacheKey 作为缓存key的请求头,默认同Headers并区分原始请求的方法与URI
+	// 配置后缓存key只包含这些请求头,同一凭据的认证结果在全部URI之间共享
+	CacheKey []string `yaml:"cache_key"`
 }
 
 // LocationConfig 路由配置
@@ -29,28 +130,92 @@ type LocationConfig struct {
 	Upstream string
 	Root     string
 	Index    string
+	// Request/Response 设置的请求/响应头,值中可使用 $request_id、$ssl_client_s_dn 等变量
 	Request  map[string]string
 	Response map[string]string
+	// ClientCert 要求已校验的客户端证书,否则返回403,在拦截器之前校验;监听须为ssl且 client_auth 为 optional|required
+	ClientCert bool `yaml:"client_cert"`
+	// Interceptors location拦截器,在server与host拦截器之后执行
+	Interceptors []InterceptorConfig
+	// Handler 使用注册的自定义处理器,优先于Upstream与Root
+	Handler HandlerConfig
+	// AuthRequest 处理请求前发送认证子请求,在全部拦截器之后执行
+	AuthRequest AuthRequestConfig `yaml:"auth_request"`
 }
 
 // HostMappingConfig host路由配置
 type HostMappingConfig struct {
-	Host      string
-	Locations []LocationConfig
+	Host string
+	// Cert/Key host证书,ssl监听按SNI选择,未配置时使用监听的默认证书
+	Cert         string
+	Key          string
+	Interceptors []InterceptorConfig
+	Locations    []LocationConfig
+}
+
+// TLSConfig 监听TLS策略
+type TLSConfig struct {
+	// MinVersion/MaxVersion 协议版本 tls1.0|tls1.1|tls1.2|tls1.3
+	MinVersion string `yaml:"min_version"`
+	MaxVersion string `yaml:"max_version"`
+	// CipherSuites 加密套件名称,如 TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (tls1.3套件不可配置)
+	CipherSuites []string `yaml:"cipher_suites"`
+	// Curves 椭圆曲线偏好 x25519|p256|p384|p521
+	Curves []string
+	// DisableSessionTickets 禁用会话票据
+	DisableSessionTickets bool `yaml:"disable_session_tickets"`
+	// SessionTicketKeyFile 票据密钥文件,每行一个32字节密钥(hex或base64),首行用于加密,文件变更自动加载
+	SessionTicketKeyFile string `yaml:"session_ticket_key_file"`
+	// SessionCacheSize 服务端会话缓存大小,大于0时会话保存在本地,忽略票据密钥文件
+	SessionCacheSize int `yaml:"session_cache_size"`
+	// ALPN 协商协议列表,仅支持 http/1.1
+	ALPN []string
+	// ClientCA 客户端证书CA文件(PEM,可包含多个证书)
+	ClientCA string `yaml:"client_ca"`
+	// ClientAuth 客户端证书校验模式 none|optional|required
+	ClientAuth string `yaml:"client_auth"`
 }
 
 // ServerConfig HTTP服务配置
 type ServerConfig struct {
+	// Listen 监听地址,如 ":80"、"tcp6:[::]:80"、"unix:/run/webrouting.sock"
 	Listen string
-	SSL    bool
-	Cert   string
-	Key    string
-	Hosts  []HostMappingConfig
+	// SocketMode/SocketOwner unix socket文件权限(如 0660)与属主(user[:group])
+	SocketMode  string `yaml:"socket_mode"`
+	SocketOwner string `yaml:"socket_owner"`
+	// ProxyProtocol 接收PROXY协议头(v1/v2),以其中的客户端地址作为请求来源
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+	// ProxyProtocolTrusted 允许发送PROXY协议头的来源地址(IP或CIDR),unix 表示信任unix socket来源,启用PROXY协议时必须配置
+	ProxyProtocolTrusted []string `yaml:"proxy_protocol_trusted"`
+	// MaxConns 监听的最大连接数,超出时关闭新连接,0则不限制;多进程模式下为每个worker的上限
+	MaxConns int `yaml:"max_conns"`
+	// MaxConnsPerIP 单个客户端IP的最大连接数(PROXY协议时为协议头中的地址),0则不限制;多进程模式下为每个worker的上限
+	MaxConnsPerIP int `yaml:"max_conns_per_ip"`
+	SSL           bool
+	// Cert/Key 默认证书,SNI未匹配任何host证书时使用
+	Cert string
+	Key  string
+	TLS  TLSConfig
+	// Interceptors 对该监听全部location生效的拦截器,按server、host、location顺序执行
+	Interceptors []InterceptorConfig
+	// HandlerMappings 注册的自定义处理器映射,按顺序优先于内置映射
+	HandlerMappings []HandlerConfig `yaml:"handler_mappings"`
+	Hosts           []HostMappingConfig
+}
+
+// RequestIDConfig 请求ID配置
+type RequestIDConfig struct {
+	Enable bool
+	// Header 请求ID头名称,默认 X-Request-Id
+	Header string
+	// Trusted 允许透传请求ID的客户端地址(IP或CIDR),为空则总是重新生成
+	Trusted []string
 }
 
 // HTTPConfig 全局Http配置
 type HTTPConfig struct {
-	Servers []ServerConfig
+	RequestID RequestIDConfig `yaml:"request_id"`
+	Servers   []ServerConfig
 }
 
 // Config 全局配置对象
@@ -74,6 +239,15 @@ var (
 
 	// CloseSignal 关闭信号
 	CloseSignal = make(chan os.Signal)
+
+	// ReloadSignal 重新加载证书信号
+	ReloadSignal = make(chan os.Signal, 1)
+
+	// UpgradeSignal 平滑升级信号,启动新的可执行文件并传递监听
+	UpgradeSignal = make(chan os.Signal, 1)
+
+	// QuitSignal 平滑退出信号,停止接收连接并等待进行中的请求完成
+	QuitSignal = make(chan os.Signal, 1)
 )
 
 func init() {
@@ -81,6 +255,9 @@ func init() {
 
 	// 注册关闭信号监听
 	signal.Notify(CloseSignal, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(ReloadSignal, syscall.SIGHUP)
+	notifyUpgradeSignal()
+	signal.Notify(QuitSignal, syscall.SIGQUIT)
 }
 
 // ParseConfig 解析Application配置
@@ -90,6 +267,15 @@ func ParseConfig(in []byte) (app *Config, err error) {
 	return
 }
 
+// ReadConfigFile 读取配置文件并返回新的配置对象,不修改GlobalConfig
+func ReadConfigFile() (*Config, error) {
+	content, err := ioutil.ReadFile(ConfPath)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(content)
+}
+
 // LoadConfigFile 读取配置文件
 func LoadConfigFile() error {
 	content, err := ioutil.ReadFile(ConfPath)
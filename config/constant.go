@@ -15,4 +15,16 @@ const (
 
 	// DefaultClientConnCount 代理客户端最大连接数
 	DefaultClientMaxConnCount int = 1024
+
+	// DefaultResolveInterval 后端节点域名重新解析间隔/ms
+	DefaultResolveInterval int64 = 30000
+
+	// DefaultCertExpiryWarnDays 证书过期告警天数
+	DefaultCertExpiryWarnDays = 30
+
+	// DefaultUpgradeDrainTimeout 升级后旧进程等待进行中请求的最长时间/ms
+	DefaultUpgradeDrainTimeout int64 = 30000
+
+	// DefaultRequestIDHeader 默认请求ID头
+	DefaultRequestIDHeader = "X-Request-Id"
 )
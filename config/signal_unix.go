@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package config
+
+import (
+	"os/signal"
+	"syscall"
+)
+
+func notifyUpgradeSignal() {
+	signal.Notify(UpgradeSignal, syscall.SIGUSR2)
+}
@@ -0,0 +1,5 @@
+package config
+
+// notifyUpgradeSignal windows不支持平滑升级
+func notifyUpgradeSignal() {
+}
@@ -0,0 +1,401 @@
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+	"github.com/ztgoto/webrouting/http/client"
+	"github.com/ztgoto/webrouting/http/httphandler"
+)
+
+// 管理接口:
+//
+//	GET  /api/config                                  当前生效配置
+//	GET  /api/listeners                               监听/host/location列表
+//	GET  /api/upstreams                               后端服务节点状态
+//	POST /api/upstreams/{id}/{drain|disable|enable}?server=addr
+//	POST /api/upstreams/{id}/servers                  添加节点 {"addr":"","max_conns":0,"weight":1}
+//	DELETE /api/upstreams/{id}/servers?server=addr    移除节点
+//	GET  /api/certificates                            证书有效期
+//	POST /api/reload                                  重新加载配置文件
+func (s *Server) startAdmin() error {
+	ac := s.cfg.Application.Admin
+	listen := strings.TrimSpace(ac.Listen)
+	if len(listen) == 0 {
+		return nil
+	}
+	if err := checkAdminListen(listen, ac.Token); err != nil {
+		return err
+	}
+	if len(ac.StateFile) > 0 {
+		if e := s.registry().LoadState(ac.StateFile); e != nil {
+			log.Printf("load upstream state [%s] error:%v\n", ac.StateFile, e)
+		}
+	}
+	// worker进程的管理接口仅供master汇总,监听本地随机端口
+	if isWorker() {
+		listen = "127.0.0.1:0"
+	}
+	ln, err := newListener(listen)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.admin = ln
+	s.adminAddr = ln.Addr().String()
+	s.raw[ac.Listen] = ln
+	s.lock.Unlock()
+	go func() {
+		if e := fasthttp.Serve(ln, s.adminHandler); e != nil {
+			log.Printf("admin server[%s] error:%v\n", listen, e)
+		}
+		log.Printf("admin server[%s] closed!", listen)
+	}()
+	log.Printf("admin server start [%s]!\n", listen)
+	return nil
+}
+
+func (s *Server) adminHandler(ctx *fasthttp.RequestCtx) {
+	if !adminAuthorized(ctx, s.Config().Application.Admin.Token) {
+		ctx.Response.Header.Set("WWW-Authenticate", "Bearer")
+		writeJSONError(ctx, fasthttp.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	path := strings.Trim(string(ctx.Path()), "/")
+	segs := strings.Split(path, "/")
+	if len(segs) < 2 || segs[0] != "api" {
+		writeJSONError(ctx, fasthttp.StatusNotFound, "not found")
+		return
+	}
+
+	switch {
+	case len(segs) == 2 && segs[1] == "config" && ctx.IsGet():
+		writeJSON(ctx, fasthttp.StatusOK, s.effectiveConfig())
+	case len(segs) == 2 && segs[1] == "listeners" && ctx.IsGet():
+		writeJSON(ctx, fasthttp.StatusOK, s.listenerStatus())
+	case len(segs) == 2 && segs[1] == "certificates" && ctx.IsGet():
+		writeJSON(ctx, fasthttp.StatusOK, s.certificateStatus())
+	case len(segs) == 2 && segs[1] == "upstreams" && ctx.IsGet():
+		writeJSON(ctx, fasthttp.StatusOK, s.upstreamStatus())
+	case len(segs) == 4 && segs[1] == "upstreams" && segs[3] == "servers" && ctx.IsPost():
+		s.addServer(ctx, segs[2])
+	case len(segs) == 4 && segs[1] == "upstreams" && segs[3] == "servers" && ctx.IsDelete():
+		s.removeServer(ctx, segs[2])
+	case len(segs) == 4 && segs[1] == "upstreams" && ctx.IsPost():
+		s.setServerState(ctx, segs[2], segs[3])
+	case len(segs) == 2 && segs[1] == "reload" && ctx.IsPost():
+		if e := s.reloadConfig(); e != nil {
+			writeJSONError(ctx, fasthttp.StatusInternalServerError, e.Error())
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusOK, map[string]string{"result": "reloaded"})
+	default:
+		writeJSONError(ctx, fasthttp.StatusNotFound, "not found")
+	}
+}
+
+// reloadConfig 读取新配置并重新加载
+func (s *Server) reloadConfig() error {
+	if s.LoadConfig == nil {
+		return errors.New("reload not supported")
+	}
+	c, err := s.LoadConfig()
+	if err != nil {
+		return err
+	}
+	return s.Reload(c)
+}
+
+// checkAdminListen 未配置token时管理接口只允许监听本地回环地址或unix socket
+func checkAdminListen(listen, token string) error {
+	if len(token) > 0 {
+		return nil
+	}
+	network, addr := parseListen(listen)
+	if network == "unix" {
+		return nil
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if host == "localhost" {
+			return nil
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			return nil
+		}
+	}
+	return fmt.Errorf("admin listen [%s] requires token unless bound to loopback or unix socket", listen)
+}
+
+func adminAuthorized(ctx *fasthttp.RequestCtx, token string) bool {
+	if len(token) == 0 {
+		return true
+	}
+	auth := string(ctx.Request.Header.Peek("Authorization"))
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) == 1
+}
+
+func (s *Server) effectiveConfig() *config.Config {
+	c := *s.Config()
+	if len(c.Application.Admin.Token) > 0 {
+		c.Application.Admin.Token = "******"
+	}
+	return &c
+}
+
+type locationStatus struct {
+	Pattern  string `json:"pattern"`
+	Upstream string `json:"upstream,omitempty"`
+	Root     string `json:"root,omitempty"`
+}
+
+type hostStatus struct {
+	Host      string           `json:"host"`
+	Locations []locationStatus `json:"locations"`
+}
+
+type listenStatus struct {
+	Listen      string       `json:"listen"`
+	SSL         bool         `json:"ssl"`
+	Active      bool         `json:"active"`
+	Connections int32        `json:"connections"`
+	Hosts       []hostStatus `json:"hosts"`
+}
+
+func (s *Server) listenerStatus() []listenStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	servers := s.cfg.HTTP.Servers
+	list := make([]listenStatus, 0, len(servers))
+	for _, v := range servers {
+		_, active := s.listeners[v.Listen]
+		ls := listenStatus{
+			Listen: v.Listen,
+			SSL:    v.SSL,
+			Active: active,
+			Hosts:  make([]hostStatus, 0, len(v.Hosts)),
+		}
+		if cl, ok := s.limits[v.Listen]; ok {
+			ls.Connections = cl.Active()
+		}
+		for _, h := range v.Hosts {
+			hs := hostStatus{
+				Host:      h.Host,
+				Locations: make([]locationStatus, 0, len(h.Locations)),
+			}
+			for _, l := range h.Locations {
+				hs.Locations = append(hs.Locations, locationStatus{
+					Pattern:  l.Pattern,
+					Upstream: l.Upstream,
+					Root:     l.Root,
+				})
+			}
+			ls.Hosts = append(ls.Hosts, hs)
+		}
+		list = append(list, ls)
+	}
+	return list
+}
+
+func (s *Server) certificateStatus() []certInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	list := make([]certInfo, 0, len(s.certStores))
+	for _, cs := range s.certStores {
+		list = append(list, cs.certificates()...)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].NotAfter.Before(list[j].NotAfter)
+	})
+	return list
+}
+
+type serverStatus struct {
+	Addr     string `json:"addr"`
+	State    string `json:"state"`
+	Healthy  bool   `json:"healthy"`
+	Fails    int    `json:"fails"`
+	Active   int    `json:"active"`
+	MaxConns int    `json:"max_conns"`
+	Weight   int    `json:"weight"`
+}
+
+type upstreamStat struct {
+	ID      string         `json:"id"`
+	Balance string         `json:"balance"`
+	Servers []serverStatus `json:"servers"`
+}
+
+// upstreamStatus 只读取已创建的后端服务组,不触发延迟创建
+func (s *Server) upstreamStatus() []upstreamStat {
+	upstreams := s.registry()
+	ucs := upstreams.Configs()
+	list := make([]upstreamStat, 0, len(ucs))
+	for _, uc := range ucs {
+		u := upstreams.Find(strings.TrimSpace(uc.ID))
+		if u == nil {
+			continue
+		}
+		us := upstreamStat{
+			ID:      u.ID,
+			Balance: u.Balance,
+		}
+		for _, v := range u.Servers() {
+			us.Servers = append(us.Servers, serverStatus{
+				Addr:     v.Addr,
+				State:    v.State().String(),
+				Healthy:  v.Healthy(),
+				Fails:    v.Fails(),
+				Active:   v.PendingRequests(),
+				MaxConns: v.MaxConns,
+				Weight:   v.Weight,
+			})
+		}
+		list = append(list, us)
+	}
+	return list
+}
+
+func (s *Server) setServerState(ctx *fasthttp.RequestCtx, id, action string) {
+	var state client.ServerState
+	switch action {
+	case "enable":
+		state = client.ServerUp
+	case "drain":
+		state = client.ServerDraining
+	case "disable":
+		state = client.ServerDown
+	default:
+		writeJSONError(ctx, fasthttp.StatusNotFound, "unknown action:"+action)
+		return
+	}
+
+	u := s.findOrCreateUpstream(id)
+	if u == nil {
+		writeJSONError(ctx, fasthttp.StatusNotFound, "upstream not found:"+id)
+		return
+	}
+	addr := string(ctx.QueryArgs().Peek("server"))
+	us := u.Get(addr)
+	if us == nil {
+		writeJSONError(ctx, fasthttp.StatusNotFound, "server not found:"+addr)
+		return
+	}
+	us.SetState(state)
+	log.Printf("admin: upstream[%s] server[%s] %s\n", id, addr, state)
+	s.saveUpstreamState()
+	writeJSON(ctx, fasthttp.StatusOK, map[string]string{"server": addr, "state": state.String()})
+}
+
+type addServerRequest struct {
+	Addr     string `json:"addr"`
+	MaxConns int    `json:"max_conns"`
+	Weight   int    `json:"weight"`
+}
+
+func (s *Server) addServer(ctx *fasthttp.RequestCtx, id string) {
+	u := s.findOrCreateUpstream(id)
+	if u == nil {
+		writeJSONError(ctx, fasthttp.StatusNotFound, "upstream not found:"+id)
+		return
+	}
+	req := &addServerRequest{}
+	if e := json.Unmarshal(ctx.PostBody(), req); e != nil {
+		writeJSONError(ctx, fasthttp.StatusBadRequest, e.Error())
+		return
+	}
+	req.Addr = strings.TrimSpace(req.Addr)
+	if e := httphandler.CheckServerAddr(req.Addr); e != nil {
+		writeJSONError(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("addr [%s] %v", req.Addr, e))
+		return
+	}
+	if req.MaxConns <= 0 {
+		req.MaxConns = config.DefaultClientMaxConnCount
+	}
+	us := client.NewServer(req.Addr, req.MaxConns)
+	if req.Weight > 0 {
+		us.Weight = req.Weight
+	}
+	if e := u.Add(us); e != nil {
+		writeJSONError(ctx, fasthttp.StatusConflict, e.Error())
+		return
+	}
+	log.Printf("admin: upstream[%s] server[%s] added\n", id, req.Addr)
+	s.saveUpstreamState()
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{"server": req.Addr, "max_conns": us.MaxConns, "weight": us.Weight})
+}
+
+func (s *Server) removeServer(ctx *fasthttp.RequestCtx, id string) {
+	u := s.findOrCreateUpstream(id)
+	if u == nil {
+		writeJSONError(ctx, fasthttp.StatusNotFound, "upstream not found:"+id)
+		return
+	}
+	addr := string(ctx.QueryArgs().Peek("server"))
+	if u.Remove(addr) == nil {
+		writeJSONError(ctx, fasthttp.StatusNotFound, "server not found:"+addr)
+		return
+	}
+	log.Printf("admin: upstream[%s] server[%s] removed\n", id, addr)
+	s.saveUpstreamState()
+	writeJSON(ctx, fasthttp.StatusOK, map[string]string{"server": addr, "result": "removed"})
+}
+
+func (s *Server) saveUpstreamState() {
+	path := s.Config().Application.Admin.StateFile
+	if len(path) == 0 {
+		return
+	}
+	if e := s.registry().SaveState(path); e != nil {
+		log.Printf("save upstream state [%s] error:%v\n", path, e)
+	}
+}
+
+// findOrCreateUpstream 后端服务组是延迟创建的,管理操作时按配置创建
+func (s *Server) findOrCreateUpstream(id string) *client.Upstream {
+	upstreams := s.registry()
+	if u := upstreams.Find(id); u != nil {
+		return u
+	}
+	uc := upstreams.Config(id)
+	if uc != nil && (len(uc.Servers) > 0 || len(uc.File) > 0 || len(uc.SRV) > 0) {
+		u, err := upstreams.Get(uc)
+		if err != nil {
+			log.Printf("admin create %v\n", err)
+			return nil
+		}
+		return u
+	}
+	return nil
+}
+
+func writeJSON(ctx *fasthttp.RequestCtx, status int, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		writeJSONError(ctx, fasthttp.StatusInternalServerError, err.Error())
+		return
+	}
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
+
+func writeJSONError(ctx *fasthttp.RequestCtx, status int, msg string) {
+	body, _ := json.Marshal(map[string]string{"error": msg})
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
@@ -0,0 +1,195 @@
+package http
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+func TestCheckAdminListen(t *testing.T) {
+	cases := map[string]bool{
+		"127.0.0.1:9090":            true,
+		"[::1]:9090":                true,
+		"localhost:9090":            true,
+		"tcp4:127.0.0.2:9090":       true,
+		"unix:/run/webrouting.sock": true,
+		":9090":                     false,
+		"0.0.0.0:9090":              false,
+		"10.0.0.1:9090":             false,
+		"[::]:9090":                 false,
+	}
+	for listen, ok := range cases {
+		if err := checkAdminListen(listen, ""); (err == nil) != ok {
+			t.Errorf("%s without token: err=%v", listen, err)
+		}
+		if err := checkAdminListen(listen, "secret"); err != nil {
+			t.Errorf("%s with token: %v", listen, err)
+		}
+	}
+
+	c, err := config.ParseConfig([]byte(`
+application:
+  admin:
+    listen: "0.0.0.0:0"
+http:
+  servers: []
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(c)
+	if err = s.Start(context.Background()); err == nil {
+		s.Close()
+		t.Fatal("admin started on all interfaces without token")
+	}
+}
+
+func TestAdminUpstreamStatus(t *testing.T) {
+	s := startTestServer(t, `
+application:
+  admin:
+    listen: "127.0.0.1:0"
+upstreams:
+  - id: backend
+    servers: ["127.0.0.1:1"]
+http:
+  servers:
+    - listen: "127.0.0.1:0"
+      hosts:
+        - host: 127.0.0.1
+          locations:
+            - pattern: "/"
+              upstream: backend
+`)
+	defer s.Close()
+
+	// 查询状态不创建后端服务组
+	body := getBody(t, "http://"+s.AdminAddr()+"/api/upstreams")
+	if strings.Contains(body, "backend") || s.upstreams.Find("backend") != nil {
+		t.Fatalf("status created upstream: %s", body)
+	}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI("http://" + s.AdminAddr() + "/api/upstreams/backend/drain?server=127.0.0.1:1")
+	if err := fasthttp.DoTimeout(req, &fasthttp.Response{}, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	body = getBody(t, "http://"+s.AdminAddr()+"/api/upstreams")
+	if !strings.Contains(body, `"state": "draining"`) {
+		t.Errorf("upstream status: %s", body)
+	}
+}
+
+func TestAdminAddServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, "state.json")
+	s := startTestServer(t, `
+application:
+  admin:
+    listen: "127.0.0.1:0"
+    state_file: "`+state+`"
+upstreams:
+  - id: backend
+    servers: ["127.0.0.1:1"]
+`)
+	defer s.Close()
+
+	post := func(body string) int {
+		req := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(req)
+		req.Header.SetMethod(fasthttp.MethodPost)
+		req.SetRequestURI("http://" + s.AdminAddr() + "/api/upstreams/backend/servers")
+		req.SetBodyString(body)
+		resp := &fasthttp.Response{}
+		if err := fasthttp.DoTimeout(req, resp, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode()
+	}
+	for _, addr := range []string{"", "foo", "unix:", "host:99999", "host:0", ":8080", "::1:8080", "host:8080;10"} {
+		if status := post(`{"addr":"` + addr + `"}`); status != fasthttp.StatusBadRequest {
+			t.Errorf("addr %q: status %d, want 400", addr, status)
+		}
+	}
+	if content, _ := ioutil.ReadFile(state); strings.Contains(string(content), "foo") {
+		t.Errorf("invalid server persisted: %s", content)
+	}
+	for _, addr := range []string{"127.0.0.1:8080", "[::1]:8080", "unix:/run/app.sock"} {
+		if status := post(`{"addr":"` + addr + `","max_conns":10,"weight":2}`); status != fasthttp.StatusOK {
+			t.Errorf("addr %q: status %d", addr, status)
+		}
+	}
+	if status := post(`{"addr":"127.0.0.1:8080"}`); status != fasthttp.StatusConflict {
+		t.Errorf("duplicated server: status %d", status)
+	}
+	u := s.registry().Find("backend")
+	if us := u.Get("127.0.0.1:8080"); us == nil || us.MaxConns != 10 || us.Weight != 2 {
+		t.Errorf("added server: %+v", us)
+	}
+	if content, _ := ioutil.ReadFile(state); !strings.Contains(string(content), `"[::1]:8080"`) {
+		t.Errorf("added server not persisted: %s", content)
+	}
+}
+
+// TestReloadConcurrentRequests 重新加载与请求并发执行,使用 -race 检查数据竞争
+func TestReloadConcurrentRequests(t *testing.T) {
+	const conf = `
+upstreams:
+  - id: backend
+    servers: ["127.0.0.1:1"]
+http:
+  servers:
+    - listen: "127.0.0.1:0"
+      hosts:
+        - host: 127.0.0.1
+          locations:
+            - pattern: "/"
+              upstream: backend
+`
+	s := startTestServer(t, conf)
+	defer s.Close()
+	url := "http://" + s.Addrs()["127.0.0.1:0"].String() + "/"
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				fasthttp.GetTimeout(nil, url, time.Second)
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		c, err := config.ParseConfig([]byte(conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Reload(c); err != nil {
+			t.Error(err)
+		}
+		s.Config()
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+}
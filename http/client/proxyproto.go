@@ -0,0 +1,151 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// ProxyProtocolV1 文本格式PROXY协议头
+	ProxyProtocolV1 = "v1"
+	// ProxyProtocolV2 二进制格式PROXY协议头
+	ProxyProtocolV2 = "v2"
+)
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ParseProxyProtocol 校验PROXY协议版本,空字符串表示不发送
+func ParseProxyProtocol(version string) (string, error) {
+	switch v := strings.ToLower(strings.TrimSpace(version)); v {
+	case "", "off":
+		return "", nil
+	case ProxyProtocolV1, ProxyProtocolV2:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown proxy_protocol:%s", version)
+}
+
+// WriteProxyHeader 写入PROXY协议头,src/dst不是TCP地址时v1写入UNKNOWN,v2写入LOCAL命令
+func WriteProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	sa, ok1 := src.(*net.TCPAddr)
+	da, ok2 := dst.(*net.TCPAddr)
+	known := ok1 && ok2
+	if version == ProxyProtocolV1 {
+		if !known {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		proto := "TCP4"
+		if sa.IP.To4() == nil || da.IP.To4() == nil {
+			proto = "TCP6"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, sa.IP, da.IP, sa.Port, da.Port)
+		return err
+	}
+
+	var b bytes.Buffer
+	b.Write(proxyV2Sig)
+	if !known {
+		// LOCAL命令,无地址
+		b.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		_, err := w.Write(b.Bytes())
+		return err
+	}
+	var addrs []byte
+	if s4, d4 := sa.IP.To4(), da.IP.To4(); s4 != nil && d4 != nil {
+		b.Write([]byte{0x21, 0x11})
+		addrs = append(append(addrs, s4...), d4...)
+	} else {
+		b.Write([]byte{0x21, 0x21})
+		addrs = append(append(addrs, sa.IP.To16()...), da.IP.To16()...)
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], uint16(sa.Port))
+	binary.BigEndian.PutUint16(ports[2:4], uint16(da.Port))
+	addrs = append(addrs, ports...)
+	size := make([]byte, 2)
+	binary.BigEndian.PutUint16(size, uint16(len(addrs)))
+	b.Write(size)
+	b.Write(addrs)
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// doProxyProtocol 使用新连接发送PROXY协议头后转发请求,请求完成后关闭连接
+// PROXY协议头描述的是整个连接,因此不能复用连接池中的连接;请求数单独计入 PendingRequests 并受MaxConns限制
+func (s *Server) doProxyProtocol(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time,
+	version string, src, dst net.Addr) error {
+	if time.Until(deadline) <= 0 {
+		return fasthttp.ErrTimeout
+	}
+	n := atomic.AddInt32(&s.proxyPending, 1)
+	defer atomic.AddInt32(&s.proxyPending, -1)
+	if s.MaxConns > 0 && int(n) > s.MaxConns {
+		return fasthttp.ErrNoFreeConns
+	}
+	addr := s.dialAddr()
+	conn, err := s.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	if err = WriteProxyHeader(conn, version, src, dst); err != nil {
+		return err
+	}
+	if s.IsTLS {
+		cfg := s.TLSConfig
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if len(cfg.ServerName) == 0 {
+			cfg = cfg.Clone()
+			if host, _, e := net.SplitHostPort(addr); e == nil {
+				cfg.ServerName = host
+			}
+		}
+		conn = tls.Client(conn, cfg)
+	}
+
+	req.SetConnectionClose()
+	bw := bufio.NewWriter(conn)
+	err = req.Write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	req.Header.ResetConnectionClose()
+	if err != nil {
+		return err
+	}
+	// HEAD请求的响应没有响应体,Content-Length描述的是对应GET请求
+	resp.SkipBody = req.Header.IsHead()
+	err = resp.Read(bufio.NewReader(conn))
+	// 与客户端的连接仍可保持
+	resp.Header.ResetConnectionClose()
+	return err
+}
+
+// dialAddr 补全默认端口
+func (s *Server) dialAddr() string {
+	if strings.HasPrefix(s.Addr, "unix:") {
+		return s.Addr
+	}
+	if _, _, err := net.SplitHostPort(s.Addr); err == nil {
+		return s.Addr
+	}
+	if s.IsTLS {
+		return net.JoinHostPort(s.Addr, "443")
+	}
+	return net.JoinHostPort(s.Addr, "80")
+}
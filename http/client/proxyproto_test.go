@@ -0,0 +1,123 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// proxyBackend 读取PROXY v1协议头与请求后调用handle写响应,连接保持打开直到测试结束
+func proxyBackend(t *testing.T, handle func(req *fasthttp.Request, c net.Conn)) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				br := bufio.NewReader(c)
+				line, err := br.ReadString('\n')
+				if err != nil || !strings.HasPrefix(line, "PROXY TCP4 203.0.113.7 ") {
+					c.Close()
+					return
+				}
+				req := &fasthttp.Request{}
+				if err = req.Read(br); err != nil {
+					c.Close()
+					return
+				}
+				handle(req, c)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestProxyProtocolRequest(t *testing.T) {
+	release := make(chan struct{})
+	ln := proxyBackend(t, func(req *fasthttp.Request, c net.Conn) {
+		if string(req.URI().Path()) == "/slow" {
+			<-release
+		}
+		// HEAD响应带Content-Length但没有响应体,连接不关闭
+		c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n"))
+		if !req.Header.IsHead() {
+			c.Write([]byte("hello"))
+		}
+	})
+	defer ln.Close()
+
+	u := NewUpstream("pp", "leastconn")
+	u.ProxyProtocol = ProxyProtocolV1
+	s := NewServer(ln.Addr().String(), 1)
+	u.Add(s)
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}
+
+	do := func(method, path string) (*fasthttp.Response, error) {
+		req := &fasthttp.Request{}
+		req.Header.SetMethod(method)
+		req.SetRequestURI("http://backend" + path)
+		resp := &fasthttp.Response{}
+		return resp, u.DoTimeoutFrom(req, resp, src, dst, 2*time.Second)
+	}
+
+	start := time.Now()
+	resp, err := do(fasthttp.MethodHead, "/")
+	if err != nil || time.Since(start) > time.Second {
+		t.Fatalf("head request: %v after %v", err, time.Since(start))
+	}
+	if resp.Header.ContentLength() != 5 {
+		t.Errorf("head content-length %d", resp.Header.ContentLength())
+	}
+	if resp, err = do(fasthttp.MethodGet, "/"); err != nil || string(resp.Body()) != "hello" {
+		t.Fatalf("get request: %v %q", err, resp.Body())
+	}
+
+	// 进行中的请求计入PendingRequests,超出MaxConns时拒绝
+	done := make(chan error, 1)
+	go func() {
+		_, err := do(fasthttp.MethodGet, "/slow")
+		done <- err
+	}()
+	for i := 0; i < 50 && s.PendingRequests() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.PendingRequests() != 1 {
+		t.Fatalf("pending requests %d", s.PendingRequests())
+	}
+	if _, err = do(fasthttp.MethodGet, "/"); err != fasthttp.ErrNoFreeConns {
+		t.Errorf("max conns not enforced: %v", err)
+	}
+	close(release)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if s.PendingRequests() != 0 {
+		t.Errorf("pending requests after completion %d", s.PendingRequests())
+	}
+}
+
+func TestUnixTLSServerName(t *testing.T) {
+	u := NewUpstream("tls", "random")
+	u.TLSConfig = &tls.Config{}
+	if err := u.Add(NewServer("unix:/run/app.sock", 10)); err != ErrUnixTLSServerName {
+		t.Errorf("unix tls server without server_name: %v", err)
+	}
+	if err := u.Replace([]*Server{NewServer("unix:/run/app.sock", 10)}); err == nil {
+		t.Error("replace accepted unix tls server without server_name")
+	}
+	u.TLSConfig = &tls.Config{ServerName: "app.internal"}
+	if err := u.Add(NewServer("unix:/run/app.sock", 10)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,356 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ServerState 后端服务节点状态
+type ServerState int32
+
+const (
+	// ServerUp 正常接收请求
+	ServerUp ServerState = iota
+	// ServerDraining 不再分配新请求,等待进行中的请求完成
+	ServerDraining
+	// ServerDown 已禁用
+	ServerDown
+)
+
+// String 状态名称
+func (s ServerState) String() string {
+	switch s {
+	case ServerUp:
+		return "up"
+	case ServerDraining:
+		return "draining"
+	case ServerDown:
+		return "down"
+	}
+	return "unknown"
+}
+
+// ParseServerState 解析状态名称,无法识别时返回ServerUp
+func ParseServerState(name string) ServerState {
+	switch name {
+	case "draining":
+		return ServerDraining
+	case "down":
+		return ServerDown
+	}
+	return ServerUp
+}
+
+const (
+	// 节点请求失败后的惩罚时间,期间视为不健康
+	failPenalty = 3 * time.Second
+)
+
+var (
+	// ErrNoAvailableServer 没有可用的后端服务节点
+	ErrNoAvailableServer = errors.New("no available upstream server")
+
+	// ErrServerExists 后端服务节点已存在
+	ErrServerExists = errors.New("upstream server already exists")
+
+	// ErrUnixTLSServerName unix socket节点使用TLS时需指定证书校验域名
+	ErrUnixTLSServerName = errors.New("tls server_name is required for unix socket server")
+)
+
+// Server 后端服务节点
+type Server struct {
+	BaseClient
+
+	// Weight 权重,小于等于0按1处理
+	Weight int
+	// ServerName 校验证书及SNI使用的域名,为空时使用Addr中的host;节点地址为DNS解析得到的IP时为原主机名
+	// 后端服务组指定了server_name时以后者为准
+	ServerName string
+
+	state    int32
+	fails    int32
+	lastFail int64
+	// proxyPending 发送PROXY协议头的请求不经过连接池,单独计数
+	proxyPending int32
+}
+
+// NewServer 创建后端服务节点,addr 为 unix:/path 时通过unix socket连接
+func NewServer(addr string, maxConns int) *Server {
+	dial := fasthttp.DialDualStack
+	if strings.HasPrefix(addr, "unix:") {
+		dial = unixDialer(addr[len("unix:"):])
+	}
+	return &Server{
+		BaseClient: BaseClient{
+			HostClient: fasthttp.HostClient{
+				Addr:         addr,
+				Dial:         dial,
+				MaxConns:     maxConns,
+				ReadTimeout:  120 * time.Second,
+				WriteTimeout: 5 * time.Second,
+			},
+		},
+		Weight: 1,
+	}
+}
+
+func unixDialer(path string) fasthttp.DialFunc {
+	return func(addr string) (net.Conn, error) {
+		return net.Dial("unix", path)
+	}
+}
+
+// PendingRequests 进行中的请求数,包括不经过连接池的PROXY协议请求
+func (s *Server) PendingRequests() int {
+	return s.HostClient.PendingRequests() + int(atomic.LoadInt32(&s.proxyPending))
+}
+
+func (s *Server) weight() int {
+	if s.Weight <= 0 {
+		return 1
+	}
+	return s.Weight
+}
+
+// State 节点状态
+func (s *Server) State() ServerState {
+	return ServerState(atomic.LoadInt32(&s.state))
+}
+
+// SetState 设置节点状态
+func (s *Server) SetState(state ServerState) {
+	atomic.StoreInt32(&s.state, int32(state))
+}
+
+// Fails 连续失败次数
+func (s *Server) Fails() int {
+	return int(atomic.LoadInt32(&s.fails))
+}
+
+// Healthy 最近一次失败已超过惩罚时间或从未失败
+func (s *Server) Healthy() bool {
+	if atomic.LoadInt32(&s.fails) == 0 {
+		return true
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastFail))) > failPenalty
+}
+
+func (s *Server) report(e error) {
+	if e == nil {
+		atomic.StoreInt32(&s.fails, 0)
+		return
+	}
+	atomic.AddInt32(&s.fails, 1)
+	atomic.StoreInt64(&s.lastFail, time.Now().UnixNano())
+}
+
+// Upstream 后端服务组,节点可在运行时修改
+type Upstream struct {
+	ID      string
+	Balance string
+	// TLSConfig 不为nil时使用HTTPS连接节点
+	TLSConfig *tls.Config
+	// ProxyProtocol 向节点发送PROXY协议头 v1|v2,为空不发送
+	ProxyProtocol string
+
+	lock    sync.RWMutex
+	servers []*Server
+	counter uint32
+}
+
+// NewUpstream 创建后端服务组
+func NewUpstream(id, balance string) *Upstream {
+	return &Upstream{
+		ID:      id,
+		Balance: balance,
+	}
+}
+
+// Add 添加节点,节点需未被使用过
+func (u *Upstream) Add(s *Server) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for _, v := range u.servers {
+		if v.Addr == s.Addr {
+			return ErrServerExists
+		}
+	}
+	if err := u.checkTLS(s); err != nil {
+		return err
+	}
+	u.applyTLS(s)
+	u.servers = append(u.servers, s)
+	return nil
+}
+
+// checkTLS unix socket地址无法推导证书域名,未指定时fasthttp会跳过证书校验
+func (u *Upstream) checkTLS(s *Server) error {
+	if u.TLSConfig != nil && strings.HasPrefix(s.Addr, "unix:") && len(s.ServerName) == 0 &&
+		len(u.TLSConfig.ServerName) == 0 && !u.TLSConfig.InsecureSkipVerify {
+		return ErrUnixTLSServerName
+	}
+	return nil
+}
+
+// applyTLS 为新节点设置TLS配置,已在使用的节点保持不变
+func (u *Upstream) applyTLS(s *Server) {
+	if u.TLSConfig == nil || s.IsTLS {
+		return
+	}
+	s.IsTLS = true
+	s.TLSConfig = u.TLSConfig
+	if len(s.ServerName) > 0 && len(u.TLSConfig.ServerName) == 0 {
+		cfg := u.TLSConfig.Clone()
+		cfg.ServerName = s.ServerName
+		s.TLSConfig = cfg
+	}
+}
+
+// Remove 移除节点,返回被移除的节点
+func (u *Upstream) Remove(addr string) *Server {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for i, v := range u.servers {
+		if v.Addr == addr {
+			servers := make([]*Server, 0, len(u.servers)-1)
+			servers = append(servers, u.servers[:i]...)
+			u.servers = append(servers, u.servers[i+1:]...)
+			return v
+		}
+	}
+	return nil
+}
+
+// Replace 替换全部节点,请求看到的始终是完整的旧列表或新列表,任一节点无效时不替换
+func (u *Upstream) Replace(servers []*Server) error {
+	list := make([]*Server, len(servers))
+	copy(list, servers)
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for _, s := range list {
+		if err := u.checkTLS(s); err != nil {
+			return fmt.Errorf("server[%s]:%v", s.Addr, err)
+		}
+	}
+	for _, s := range list {
+		u.applyTLS(s)
+	}
+	u.servers = list
+	return nil
+}
+
+// Get 获取节点
+func (u *Upstream) Get(addr string) *Server {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	for _, v := range u.servers {
+		if v.Addr == addr {
+			return v
+		}
+	}
+	return nil
+}
+
+// Servers 节点列表快照
+func (u *Upstream) Servers() []*Server {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	servers := make([]*Server, len(u.servers))
+	copy(servers, u.servers)
+	return servers
+}
+
+// DoTimeout 选择节点并发送请求
+func (u *Upstream) DoTimeout(req *fasthttp.Request, resp *fasthttp.Response, timeout time.Duration) error {
+	return u.DoTimeoutFrom(req, resp, nil, nil, timeout)
+}
+
+// DoTimeoutFrom 选择节点并发送请求,src/dst 为客户端连接地址,启用PROXY协议时发送给节点
+func (u *Upstream) DoTimeoutFrom(req *fasthttp.Request, resp *fasthttp.Response, src, dst net.Addr, timeout time.Duration) error {
+	s := u.pick()
+	if s == nil {
+		return ErrNoAvailableServer
+	}
+	deadline := time.Now().Add(timeout)
+	// HostClient要求请求的scheme与节点协议一致,代理的请求保留的是客户端连接的scheme
+	scheme := string(req.URI().Scheme())
+	if s.IsTLS {
+		req.URI().SetScheme("https")
+	} else {
+		req.URI().SetScheme("http")
+	}
+	defer req.URI().SetScheme(scheme)
+	var e error
+	if len(u.ProxyProtocol) > 0 {
+		e = s.doProxyProtocol(req, resp, deadline, u.ProxyProtocol, src, dst)
+	} else {
+		// 必须调用BaseClient.DoDeadline,HostClient.DoTimeout不会经过覆盖的方法
+		e = s.DoDeadline(req, resp, deadline)
+	}
+	s.report(e)
+	return e
+}
+
+func (u *Upstream) pick() *Server {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	candidates := make([]*Server, 0, len(u.servers))
+	for _, v := range u.servers {
+		if v.State() == ServerUp && v.Healthy() {
+			candidates = append(candidates, v)
+		}
+	}
+	// 全部不健康时仍尝试启用中的节点
+	if len(candidates) == 0 {
+		for _, v := range u.servers {
+			if v.State() == ServerUp {
+				candidates = append(candidates, v)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch u.Balance {
+	case "roundrobin":
+		n := atomic.AddUint32(&u.counter, 1)
+		return weightedAt(candidates, int(n))
+	case "leastconn":
+		hit := candidates[0]
+		for _, v := range candidates[1:] {
+			if v.PendingRequests()*hit.weight() < hit.PendingRequests()*v.weight() {
+				hit = v
+			}
+		}
+		return hit
+	default:
+		return weightedAt(candidates, rand.Int())
+	}
+}
+
+// weightedAt 按权重将n映射到节点
+func weightedAt(candidates []*Server, n int) *Server {
+	total := 0
+	for _, v := range candidates {
+		total += v.weight()
+	}
+	n %= total
+	for _, v := range candidates {
+		n -= v.weight()
+		if n < 0 {
+			return v
+		}
+	}
+	return candidates[len(candidates)-1]
+}
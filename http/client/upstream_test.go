@@ -0,0 +1,50 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestUpstreamAddRemove(t *testing.T) {
+	u := NewUpstream("test", "roundrobin")
+	if e := u.Add(NewServer("127.0.0.1:8080", 10)); e != nil {
+		t.Fatal(e)
+	}
+	if e := u.Add(NewServer("127.0.0.1:8080", 10)); e != ErrServerExists {
+		t.Errorf("duplicate server added, err:%v", e)
+	}
+	u.Add(NewServer("127.0.0.1:8081", 10))
+	if u.Remove("127.0.0.1:8080") == nil {
+		t.Error("server not removed")
+	}
+	if len(u.Servers()) != 1 {
+		t.Errorf("server count %d", len(u.Servers()))
+	}
+}
+
+func TestUpstreamPick(t *testing.T) {
+	u := NewUpstream("test", "roundrobin")
+	a := NewServer("127.0.0.1:8080", 10)
+	a.Weight = 3
+	b := NewServer("127.0.0.1:8081", 10)
+	u.Add(a)
+	u.Add(b)
+
+	hits := map[*Server]int{}
+	for i := 0; i < 400; i++ {
+		hits[u.pick()]++
+	}
+	if hits[a] != 300 || hits[b] != 100 {
+		t.Errorf("weighted pick a:%d b:%d", hits[a], hits[b])
+	}
+
+	a.SetState(ServerDraining)
+	for i := 0; i < 10; i++ {
+		if u.pick() != b {
+			t.Fatal("draining server picked")
+		}
+	}
+	b.SetState(ServerDown)
+	if u.pick() != nil {
+		t.Error("down server picked")
+	}
+}
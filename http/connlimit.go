@@ -0,0 +1,192 @@
+package http
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ztgoto/webrouting/config"
+)
+
+var (
+	errConnLimit = errors.New("too many connections per ip")
+
+	// connLimitResponse 非SSL监听拒绝连接时返回的响应
+	connLimitResponse = []byte("HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+)
+
+const (
+	// connLimitWriteTimeout 写入拒绝响应的超时时间
+	connLimitWriteTimeout = 100 * time.Millisecond
+
+	// connLimitLogInterval 拒绝连接日志的最小间隔,避免连接洪水时日志过多
+	connLimitLogInterval = time.Minute
+)
+
+// connLimiter 监听的连接数限制,超出总数时在Accept后立即关闭,超出单IP连接数时在首次读取时关闭
+// 单IP计数在首次读取时进行,此时PROXY协议头已解析,且不会因慢连接阻塞Accept
+type connLimiter struct {
+	listen   string
+	maxConns int32
+	maxPerIP int32
+	active   int32
+	// reject 非SSL监听在关闭前写入503响应
+	reject bool
+
+	lock    sync.Mutex
+	perIP   map[string]int
+	lastLog time.Time
+}
+
+func newConnLimiter(sc *config.ServerConfig) *connLimiter {
+	cl := &connLimiter{
+		listen: sc.Listen,
+		reject: !sc.SSL,
+		perIP:  make(map[string]int, 64),
+	}
+	cl.update(sc)
+	return cl
+}
+
+// update 更新连接上限,已建立的连接不受影响
+func (cl *connLimiter) update(sc *config.ServerConfig) {
+	atomic.StoreInt32(&cl.maxConns, int32(sc.MaxConns))
+	atomic.StoreInt32(&cl.maxPerIP, int32(sc.MaxConnsPerIP))
+}
+
+// Active 当前连接数
+func (cl *connLimiter) Active() int32 {
+	return atomic.LoadInt32(&cl.active)
+}
+
+func (cl *connLimiter) wrap(ln net.Listener) net.Listener {
+	return &limitListener{Listener: ln, cl: cl}
+}
+
+func (cl *connLimiter) register(ip string, max int) bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if cl.perIP[ip] >= max {
+		return false
+	}
+	cl.perIP[ip]++
+	return true
+}
+
+func (cl *connLimiter) unregister(ip string) {
+	cl.lock.Lock()
+	if cl.perIP[ip] <= 1 {
+		delete(cl.perIP, ip)
+	} else {
+		cl.perIP[ip]--
+	}
+	cl.lock.Unlock()
+}
+
+func (cl *connLimiter) rejected(c net.Conn, reason string) {
+	if cl.reject {
+		c.SetWriteDeadline(time.Now().Add(connLimitWriteTimeout))
+		c.Write(connLimitResponse)
+	}
+	c.Close()
+	cl.lock.Lock()
+	logged := time.Since(cl.lastLog) >= connLimitLogInterval
+	if logged {
+		cl.lastLog = time.Now()
+	}
+	cl.lock.Unlock()
+	if logged {
+		log.Printf("listen [%s] connection from %s rejected:%s\n", cl.listen, c.RemoteAddr(), reason)
+	}
+}
+
+// limitListener 限制连接数的监听,位于PROXY协议解析之后、TLS之前
+type limitListener struct {
+	net.Listener
+	cl *connLimiter
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		n := atomic.AddInt32(&l.cl.active, 1)
+		if max := atomic.LoadInt32(&l.cl.maxConns); max > 0 && n > max {
+			atomic.AddInt32(&l.cl.active, -1)
+			// 写入响应可能阻塞,不在Accept中进行
+			go l.cl.rejected(c, "max_conns exceeded")
+			continue
+		}
+		return &limitConn{Conn: c, cl: l.cl}, nil
+	}
+}
+
+// limitConn 关闭时释放计数
+type limitConn struct {
+	net.Conn
+	cl        *connLimiter
+	checkOnce sync.Once
+	err       error
+
+	// lock 保护ip与closed,计数过程中连接可能已被关闭
+	lock   sync.Mutex
+	ip     string
+	closed bool
+}
+
+// check 首次读取时按客户端IP计数,未限制单IP连接数或unix socket来源时不计数
+func (c *limitConn) check() {
+	c.checkOnce.Do(func() {
+		max := int(atomic.LoadInt32(&c.cl.maxPerIP))
+		if max <= 0 {
+			return
+		}
+		ta, ok := c.Conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return
+		}
+		ip := ta.IP.String()
+		if !c.cl.register(ip, max) {
+			c.err = errConnLimit
+			c.cl.rejected(c.Conn, "max_conns_per_ip exceeded")
+			return
+		}
+		c.lock.Lock()
+		closed := c.closed
+		if !closed {
+			c.ip = ip
+		}
+		c.lock.Unlock()
+		if closed {
+			c.cl.unregister(ip)
+		}
+	})
+}
+
+func (c *limitConn) Read(b []byte) (int, error) {
+	c.check()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *limitConn) Close() error {
+	c.lock.Lock()
+	closed, ip := c.closed, c.ip
+	c.closed = true
+	c.ip = ""
+	c.lock.Unlock()
+	if !closed {
+		atomic.AddInt32(&c.cl.active, -1)
+		if len(ip) > 0 {
+			c.cl.unregister(ip)
+		}
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,84 @@
+package http
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ztgoto/webrouting/config"
+)
+
+func TestConnLimiter(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := newConnLimiter(&config.ServerConfig{Listen: "test", MaxConns: 1})
+	ln := cl.wrap(raw)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", raw.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	// rejectedResponse 被拒绝的连接收到503后关闭
+	rejectedResponse := func(c net.Conn) string {
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		b, _ := ioutil.ReadAll(c)
+		c.Close()
+		return string(b)
+	}
+
+	c1 := dial()
+	defer c1.Close()
+	a1 := <-accepted
+	if cl.Active() != 1 {
+		t.Fatalf("active = %d, want 1", cl.Active())
+	}
+	if resp := rejectedResponse(dial()); !strings.HasPrefix(resp, "HTTP/1.1 503") {
+		t.Errorf("over max_conns: %q", resp)
+	}
+	a1.Close()
+	a1.Close()
+	if cl.Active() != 0 {
+		t.Fatalf("active = %d after close, want 0", cl.Active())
+	}
+
+	// 单IP连接数在首次读取时检查
+	cl.update(&config.ServerConfig{MaxConnsPerIP: 1})
+	c2 := dial()
+	defer c2.Close()
+	c2.Write([]byte("x"))
+	a2 := <-accepted
+	defer a2.Close()
+	if _, err = a2.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	c3 := dial()
+	a3 := <-accepted
+	if _, err = a3.Read(make([]byte, 1)); err != errConnLimit {
+		t.Errorf("over max_conns_per_ip: err=%v", err)
+	}
+	if resp := rejectedResponse(c3); !strings.HasPrefix(resp, "HTTP/1.1 503") {
+		t.Errorf("over max_conns_per_ip: %q", resp)
+	}
+	a3.Close()
+	if cl.Active() != 1 || len(cl.perIP) != 1 {
+		t.Errorf("active = %d perIP = %v, want 1", cl.Active(), cl.perIP)
+	}
+}
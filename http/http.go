@@ -1,10 +1,15 @@
 package http
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"log"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ztgoto/webrouting/http/httphandler"
 
@@ -12,65 +17,419 @@ import (
 	"github.com/ztgoto/webrouting/config"
 )
 
-var (
-	w sync.WaitGroup
+// Server 一组http监听及其路由、证书、后端服务与管理接口,同一进程可创建多个
+type Server struct {
+	// LoadConfig 管理接口 /api/reload 读取新配置,为nil时不支持重新加载
+	LoadConfig func() (*config.Config, error)
 
-	// ListenList http服务监听列表
-	ListenList map[string]net.Listener
-)
+	cfg *config.Config
+	// zones 本实例的命名限流区域,重新加载配置时保留计数
+	zones *httphandler.RateLimitZones
 
-// StartServer 启动服务
-func StartServer() {
+	// lock 保护以下字段
+	lock sync.Mutex
+	// upstreams 后端服务组注册表,重新加载配置时替换
+	upstreams *httphandler.UpstreamRegistry
+	// listeners 各监听地址的监听,关闭时释放证书监听等后台任务
+	listeners map[string]net.Listener
+	// raw 各监听地址的原始监听,升级时传递其文件描述符
+	raw map[string]net.Listener
+	// dispatches 各监听地址当前使用的路由分发,重新加载配置时原子替换
+	dispatches map[string]*dispatchHolder
+	// certStores ssl监听的证书
+	certStores map[string]*certStore
+	// servers 各监听地址的服务,关闭时平滑停止
+	servers map[string]*fasthttp.Server
+	// limits 各监听地址的连接数限制,重新加载配置时更新上限
+	limits map[string]*connLimiter
+	conns  connTracker
+
+	admin     net.Listener
+	adminAddr string
+
+	wg   sync.WaitGroup
+	done chan struct{}
+	once sync.Once
+}
+
+// dispatchHolder 可替换的路由分发
+type dispatchHolder struct {
+	v atomic.Value
+}
 
-	initHTTPServer()
+func (h *dispatchHolder) DoDispatch(ctx *fasthttp.RequestCtx) {
+	h.v.Load().(*httphandler.Dispatch).DoDispatch(ctx)
+}
+
+// connTracker 记录客户端连接状态,平滑关闭时断开空闲的keep-alive连接
+type connTracker struct {
+	lock  sync.Mutex
+	conns map[net.Conn]fasthttp.ConnState
+}
+
+func (t *connTracker) setState(c net.Conn, state fasthttp.ConnState) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if state == fasthttp.StateClosed || state == fasthttp.StateHijacked {
+		delete(t.conns, c)
+		return
+	}
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]fasthttp.ConnState, 64)
+	}
+	t.conns[c] = state
+}
+
+// close 关闭空闲连接,all为true时关闭全部连接
+func (t *connTracker) close(all bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for c, state := range t.conns {
+		if all || state == fasthttp.StateIdle {
+			c.Close()
+			delete(t.conns, c)
+		}
+	}
+}
+
+// NewServer 使用配置创建服务,调用 Start 后开始监听
+func NewServer(cfg *config.Config) *Server {
+	return &Server{
+		cfg:        cfg,
+		upstreams:  httphandler.NewUpstreamRegistry(cfg.Upstreams),
+		zones:      httphandler.NewRateLimitZones(),
+		listeners:  make(map[string]net.Listener, len(cfg.HTTP.Servers)),
+		raw:        make(map[string]net.Listener, len(cfg.HTTP.Servers)+1),
+		dispatches: make(map[string]*dispatchHolder, len(cfg.HTTP.Servers)),
+		certStores: make(map[string]*certStore, 4),
+		servers:    make(map[string]*fasthttp.Server, len(cfg.HTTP.Servers)),
+		limits:     make(map[string]*connLimiter, len(cfg.HTTP.Servers)),
+		done:       make(chan struct{}),
+	}
+}
+
+// StartServer 使用 config.GlobalConfig 启动服务并处理进程信号,服务停止后返回
+func StartServer() {
+	s := NewServer(config.GlobalConfig)
+	s.LoadConfig = config.ReadConfigFile
+	if err := s.Start(context.Background()); err != nil {
+		panic(err)
+	}
+	closeInherited()
+	notifyReady(s.AdminAddr())
 	log.Println("http server start success!")
-	select {
-	case <-config.CloseSignal:
-		log.Println("---close server---")
-		CloseServer()
+	for {
+		select {
+		case <-config.ReloadSignal:
+			log.Println("---reload certificates---")
+			s.ReloadCertificates()
+		case <-config.UpgradeSignal:
+			if isWorker() {
+				log.Println("worker process upgrade is managed by master, ignored")
+				continue
+			}
+			log.Println("---upgrade---")
+			if err := s.Upgrade(); err != nil {
+				log.Printf("upgrade failed, keep serving:%v\n", err)
+				continue
+			}
+			s.drain()
+			log.Println("---upgraded, old process exit---")
+			return
+		case <-config.QuitSignal:
+			log.Println("---graceful shutdown---")
+			s.drain()
+			log.Println("---all closed---")
+			return
+		case <-config.CloseSignal:
+			log.Println("---close server---")
+			s.Close()
+			s.Wait()
+			log.Println("---all closed---")
+			return
+		}
+	}
+}
+
+// Start 启动全部监听与管理接口,任一监听失败时关闭已启动的监听并返回错误
+// ctx 结束时平滑关闭服务,等待时间为 upgrade_drain_timeout
+func (s *Server) Start(ctx context.Context) error {
+	if err := httphandler.ValidateUpstreams(s.cfg.Upstreams); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	servers := s.cfg.HTTP.Servers
+	for i := range servers {
+		if err := s.startListen(&servers[i]); err != nil {
+			s.lock.Unlock()
+			s.Close()
+			return err
+		}
+	}
+	s.lock.Unlock()
+
+	if err := s.startAdmin(); err != nil {
+		s.Close()
+		return err
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.drain()
+			case <-s.done:
+			}
+		}()
+	}
+	return nil
+}
+
+// Shutdown 停止接收新连接并等待进行中的请求完成,ctx 结束时不再等待并返回ctx的错误
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	servers := make([]*fasthttp.Server, 0, len(s.servers))
+	for _, v := range s.servers {
+		servers = append(servers, v)
+	}
+	s.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, v := range servers {
+		wg.Add(1)
+		go func(v *fasthttp.Server) {
+			defer wg.Done()
+			v.Shutdown()
+		}(v)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// 空闲连接不会再收到请求,需主动关闭才能完成等待
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	var err error
+	for err == nil {
+		s.conns.close(false)
+		select {
+		case <-done:
+			s.Close()
+			return nil
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	s.conns.close(true)
+	s.Close()
+	return err
+}
+
+// drain 平滑关闭,超过 upgrade_drain_timeout 后直接返回
+func (s *Server) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout(&s.cfg.Application))
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Println("drain timeout, close remaining connections")
+	}
+}
+
+// Close 立即关闭全部监听与管理接口,不等待进行中的请求
+func (s *Server) Close() {
+	s.lock.Lock()
+	if s.admin != nil {
+		s.admin.Close()
 	}
-	w.Wait()
-	log.Println("---all closed---")
+	for _, v := range s.listeners {
+		v.Close()
+	}
+	upstreams := s.upstreams
+	s.lock.Unlock()
+	upstreams.Close()
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// Wait 等待全部监听的服务退出
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+// AdminAddr 管理接口实际监听地址,未启用时为空
+func (s *Server) AdminAddr() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.adminAddr
+}
+
+// Addrs 各监听地址实际监听的地址
+func (s *Server) Addrs() map[string]net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	addrs := make(map[string]net.Addr, len(s.listeners))
+	for listen, ln := range s.listeners {
+		addrs[listen] = ln.Addr()
+	}
+	return addrs
 }
 
-// CloseServer 关闭服务
-func CloseServer() {
-	if ListenList != nil && len(ListenList) > 0 {
-		for _, v := range ListenList {
-			v.Close()
+// Config 当前生效的配置
+func (s *Server) Config() *config.Config {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.cfg
+}
+
+// ReloadCertificates 重新加载全部ssl监听的证书
+func (s *Server) ReloadCertificates() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, cs := range s.certStores {
+		cs.reload()
+	}
+}
+
+// Reload 使用新配置替换路由与后端服务与证书,启动新增监听并关闭已移除的监听
+// 仅 upstreams 与 http 部分生效,已存在监听的TLS策略变更需重启生效
+// 后端服务配置或任一路由无效时返回错误,当前配置保持不变
+func (s *Server) Reload(cfg *config.Config) error {
+	if err := httphandler.ValidateUpstreams(cfg.Upstreams); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	nc := *s.cfg
+	nc.Upstreams = cfg.Upstreams
+	nc.HTTP = cfg.HTTP
+	upstreams := httphandler.NewUpstreamRegistry(nc.Upstreams)
+	upstreams.Inherit(s.upstreams)
+
+	// 先创建全部路由,任一失败时不做变更
+	dispatches := make(map[string]*httphandler.Dispatch, len(nc.HTTP.Servers))
+	for i := range nc.HTTP.Servers {
+		v := &nc.HTTP.Servers[i]
+		d, err := s.newDispatch(&nc, upstreams, v)
+		if err != nil {
+			upstreams.Close()
+			return err
+		}
+		dispatches[v.Listen] = d
+	}
+
+	old := s.upstreams
+	s.cfg = &nc
+	s.upstreams = upstreams
+	old.Close()
+	list := make([]*httphandler.Dispatch, 0, len(dispatches))
+	for _, d := range dispatches {
+		list = append(list, d)
+	}
+	s.zones.Retain(list)
+
+	var errs []string
+	listens := make(map[string]bool, len(nc.HTTP.Servers))
+	for i := range nc.HTTP.Servers {
+		v := &nc.HTTP.Servers[i]
+		listens[v.Listen] = true
+		if h, ok := s.dispatches[v.Listen]; ok {
+			h.v.Store(dispatches[v.Listen])
+			if cl, ok := s.limits[v.Listen]; ok {
+				cl.update(v)
+			}
+			if cs, ok := s.certStores[v.Listen]; ok && v.SSL {
+				if err := cs.update(v); err != nil {
+					log.Printf("reload listen [%s] certificate error, keep current:%v\n", v.Listen, err)
+					errs = append(errs, fmt.Sprintf("listen:%s certificate %v", v.Listen, err))
+				}
+			}
+			continue
+		}
+		if err := s.listen(v, dispatches[v.Listen]); err != nil {
+			log.Printf("reload listen [%s] error:%v\n", v.Listen, err)
+			errs = append(errs, fmt.Sprintf("listen:%s %v", v.Listen, err))
 		}
 	}
+	for listen, ln := range s.listeners {
+		if !listens[listen] {
+			ln.Close()
+			delete(s.raw, listen)
+			delete(s.servers, listen)
+			delete(s.listeners, listen)
+			delete(s.dispatches, listen)
+			delete(s.certStores, listen)
+			delete(s.limits, listen)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("config reloaded with errors: %s", strings.Join(errs, "; "))
+	}
+	log.Println("config reloaded")
+	return nil
 }
 
-func initHTTPServer() {
-	httpConfigList := &config.GlobalConfig.HTTP.Servers
+// registry 当前的后端服务组注册表
+func (s *Server) registry() *httphandler.UpstreamRegistry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.upstreams
+}
 
-	if len(*httpConfigList) > 0 && ListenList == nil {
-		ListenList = make(map[string]net.Listener, len(*httpConfigList))
+func (s *Server) newDispatch(cfg *config.Config, upstreams *httphandler.UpstreamRegistry, v *config.ServerConfig) (*httphandler.Dispatch, error) {
+	hostMap := toHostMap(v)
+	dispatch, err := httphandler.NewServerDispatch(v, hostMap, upstreams, s.zones)
+	if err != nil {
+		return nil, fmt.Errorf("listen:%s %v", v.Listen, err)
 	}
-	for _, v := range *httpConfigList {
+	dispatch.RequestID = httphandler.NewRequestIDHandler(&cfg.HTTP.RequestID)
+	return dispatch, nil
+}
 
-		hostMap := toHostMap(&v)
-		dispatch := httphandler.NewDefaultDispathc(hostMap)
+// startListen 启动单个监听,调用方需持有lock
+func (s *Server) startListen(v *config.ServerConfig) error {
+	dispatch, err := s.newDispatch(s.cfg, s.upstreams, v)
+	if err != nil {
+		return err
+	}
+	return s.listen(v, dispatch)
+}
 
-		listen := v.Listen
-		ssl := v.SSL
-		var ln net.Listener
-		var err error
-		if ssl {
-			cert := v.Cert
-			key := v.Key
-			ln, err = createServerTLS(listen, cert, key, dispatch.DoDispatch)
+// listen 使用已创建的路由启动监听,调用方需持有lock
+func (s *Server) listen(v *config.ServerConfig, dispatch *httphandler.Dispatch) (err error) {
+	holder := &dispatchHolder{}
+	holder.v.Store(dispatch)
 
-		} else {
-			ln, err = createServer(listen, dispatch.DoDispatch)
+	listen := v.Listen
+	var ln net.Listener
+	if v.SSL {
+		tlsConfig, cs, stop, e := newServerTLSConfig(v, certExpiryWarnDays(&s.cfg.Application))
+		if e != nil {
+			return e
 		}
+		ln, err = s.createServerTLS(v, tlsConfig, holder.DoDispatch)
 		if err != nil {
-			panic(err)
+			stop()
+			return err
 		}
-		ListenList[listen] = ln
-		log.Printf("http server start [%s]!\n", listen)
+		ln = withCloseHook(ln, stop)
+		s.certStores[listen] = cs
+	} else {
+		ln, err = s.createServer(v, holder.DoDispatch)
 	}
+	if err != nil {
+		return err
+	}
+	s.listeners[listen] = ln
+	s.dispatches[listen] = holder
+	log.Printf("http server start [%s]!\n", listen)
+	return nil
 }
 
 func toHostMap(server *config.ServerConfig) map[string][]*config.LocationConfig {
@@ -90,8 +449,8 @@ func toHostMap(server *config.ServerConfig) map[string][]*config.LocationConfig
 			}
 			if v.Locations != nil && len(v.Locations) > 0 {
 				lcs := make([]*config.LocationConfig, len(v.Locations))
-				for i, loc := range v.Locations {
-					lcs[i] = &loc
+				for i := range v.Locations {
+					lcs[i] = &v.Locations[i]
 				}
 				hm[host] = lcs
 			}
@@ -102,41 +461,78 @@ func toHostMap(server *config.ServerConfig) map[string][]*config.LocationConfig
 }
 
 // 创建http服务器
-func createServer(addr string, handler fasthttp.RequestHandler) (ln net.Listener, e error) {
-	ln, e = net.Listen("tcp4", addr)
+func (s *Server) createServer(sc *config.ServerConfig, handler fasthttp.RequestHandler) (ln net.Listener, e error) {
+	ln, e = s.openListener(sc)
 	if e != nil {
 		return
 	}
-
-	go func() {
-		w.Add(1)
-		e := fasthttp.Serve(ln, handler)
-		w.Done()
-		log.Printf("http server[%s] closed!", addr)
-		if e != nil {
-			panic(e)
-		}
-	}()
-	log.Printf("create Listen [%s]\n", addr)
+	s.serve(sc.Listen, ln, handler)
 	return
 }
 
 // 创建https服务器
-func createServerTLS(addr, cert, key string, handler fasthttp.RequestHandler) (ln net.Listener, e error) {
-	ln, e = net.Listen("tcp4", addr)
+func (s *Server) createServerTLS(sc *config.ServerConfig, tlsConfig *tls.Config, handler fasthttp.RequestHandler) (ln net.Listener, e error) {
+	ln, e = s.openListener(sc)
 	if e != nil {
 		return
 	}
+	ln = tls.NewListener(ln, tlsConfig)
+	s.serve(sc.Listen, ln, handler)
+	return
+}
+
+// openListener 创建监听,启用PROXY协议时在TLS之前解析协议头,连接数限制位于两者之间
+func (s *Server) openListener(sc *config.ServerConfig) (net.Listener, error) {
+	ln, err := newListener(sc.Listen)
+	if err != nil {
+		return nil, err
+	}
+	// 在登记与开始服务之前设置权限,失败时不会留下半启动的监听
+	if network, path := parseListen(sc.Listen); network == "unix" {
+		if err = setSocketPerm(path, sc.SocketMode, sc.SocketOwner); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	s.raw[sc.Listen] = ln
+	if sc.ProxyProtocol {
+		// 必须明确指定可信来源,否则任何客户端都可以伪造来源地址
+		trusted, unix := parseProxyTrusted(sc.ProxyProtocolTrusted)
+		if len(trusted) == 0 && !unix {
+			ln.Close()
+			delete(s.raw, sc.Listen)
+			return nil, fmt.Errorf("listen:%s proxy_protocol requires proxy_protocol_trusted", sc.Listen)
+		}
+		// unix socket监听的来源都不是IP地址,只能通过 unix 关键字信任
+		if network, _ := parseListen(sc.Listen); network == "unix" && !unix {
+			ln.Close()
+			delete(s.raw, sc.Listen)
+			return nil, fmt.Errorf("listen:%s proxy_protocol on unix socket requires proxy_protocol_trusted: [%s]", sc.Listen, proxyTrustedUnix)
+		}
+		ln = newProxyListener(ln, trusted, unix)
+		log.Printf("listen [%s] proxy protocol enabled, trusted:%v\n", sc.Listen, sc.ProxyProtocolTrusted)
+	}
+	// 未配置上限时同样创建,重新加载配置后可启用
+	cl := newConnLimiter(sc)
+	s.limits[sc.Listen] = cl
+	return cl.wrap(ln), nil
+}
 
+func (s *Server) serve(addr string, ln net.Listener, handler fasthttp.RequestHandler) {
+	fs := &fasthttp.Server{
+		Handler:   handler,
+		ConnState: s.conns.setState,
+	}
+	s.servers[addr] = fs
+	s.wg.Add(1)
 	go func() {
-		w.Add(1)
-		e := fasthttp.ServeTLS(ln, cert, key, handler)
-		w.Done()
-		log.Printf("http server[%s] closed!", addr)
+		e := fs.Serve(ln)
+		s.wg.Done()
 		if e != nil {
-			panic(e)
+			log.Printf("http server[%s] closed with error:%v\n", addr, e)
+			return
 		}
+		log.Printf("http server[%s] closed!", addr)
 	}()
 	log.Printf("create Listen [%s]\n", addr)
-	return
 }
@@ -0,0 +1,306 @@
+package httphandler
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// remoteUserKey 认证通过的用户名,$remote_user 变量取值
+const remoteUserKey = "remote_user"
+
+// basicAuthInterceptor HTTP Basic认证,用户来自htpasswd文件
+//
+//	args:
+//	  realm:               认证域,默认 Restricted
+//	  htpasswd:            htpasswd文件,支持bcrypt、{SHA}、$apr1$,文件变更时自动重新加载
+//	  users:               允许的用户,逗号分隔,与groups都为空时允许全部用户
+//	  groups:              允许的组,逗号分隔
+//	  group_file:          组文件,每行 group: user1 user2
+//	  strip_authorization: true 时转发前移除Authorization头
+type basicAuthInterceptor struct {
+	realm  string
+	users  map[string]bool
+	groups []string
+	strip  bool
+
+	passwd    *reloadFile
+	groupFile *reloadFile
+
+	// verified 校验通过的用户名与密码摘要,避免每次请求都计算bcrypt
+	verified sync.Map
+}
+
+func newBasicAuthInterceptor(args map[string]string) (HandlerInterceptor, error) {
+	path := strings.TrimSpace(args["htpasswd"])
+	if len(path) == 0 {
+		return nil, fmt.Errorf("htpasswd is required")
+	}
+	passwd, err := newReloadFile(path, parseHtpasswd)
+	if err != nil {
+		return nil, err
+	}
+	realm := strings.TrimSpace(args["realm"])
+	if len(realm) == 0 {
+		realm = "Restricted"
+	}
+	strip, err := argBool(args, "strip_authorization")
+	if err != nil {
+		return nil, err
+	}
+	bai := &basicAuthInterceptor{
+		realm:  realm,
+		groups: argList(args, "groups"),
+		strip:  strip,
+		passwd: passwd,
+	}
+	if users := argList(args, "users"); len(users) > 0 {
+		bai.users = make(map[string]bool, len(users))
+		for _, u := range users {
+			bai.users[u] = true
+		}
+	}
+	if file := strings.TrimSpace(args["group_file"]); len(file) > 0 {
+		if bai.groupFile, err = newReloadFile(file, parseGroupFile); err != nil {
+			return nil, err
+		}
+	} else if len(bai.groups) > 0 {
+		return nil, fmt.Errorf("groups requires group_file")
+	}
+	return bai, nil
+}
+
+func (bai *basicAuthInterceptor) PreHandle(ctx *fasthttp.RequestCtx) bool {
+	user, password, ok := parseBasicAuth(ctx.Request.Header.Peek("Authorization"))
+	if !ok || !bai.authenticate(user, password) {
+		ErrorPage(ctx, fasthttp.StatusUnauthorized)
+		ctx.Response.Header.Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", bai.realm))
+		return false
+	}
+	if !bai.allowed(user) {
+		log.Printf("[%s] basic auth user [%s] not allowed for %s\n", RequestID(ctx), user, ctx.Path())
+		ErrorPage(ctx, fasthttp.StatusForbidden)
+		return false
+	}
+	ctx.SetUserValue(remoteUserKey, user)
+	if bai.strip {
+		ctx.Request.Header.Del("Authorization")
+	}
+	return true
+}
+
+func (bai *basicAuthInterceptor) PostHandle(ctx *fasthttp.RequestCtx) {
+}
+
+func (bai *basicAuthInterceptor) AfterCompletion(ctx *fasthttp.RequestCtx) {
+}
+
+func (bai *basicAuthInterceptor) authenticate(user, password string) bool {
+	hash, ok := bai.passwd.Get().(map[string]string)[user]
+	if !ok {
+		return false
+	}
+	// 摘要包含hash,文件中的密码变更后原缓存不再命中
+	sum := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+	key := string(sum[:])
+	if _, ok = bai.verified.Load(key); ok {
+		return true
+	}
+	if !checkPassword(hash, password) {
+		return false
+	}
+	bai.verified.Store(key, true)
+	return true
+}
+
+func (bai *basicAuthInterceptor) allowed(user string) bool {
+	if bai.users == nil && len(bai.groups) == 0 {
+		return true
+	}
+	if bai.users[user] {
+		return true
+	}
+	if bai.groupFile == nil {
+		return false
+	}
+	members := bai.groupFile.Get().(map[string]map[string]bool)
+	for _, g := range bai.groups {
+		if members[g][user] {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBasicAuth 解析 Basic base64(user:password) 格式的Authorization头
+func parseBasicAuth(auth []byte) (user, password string, ok bool) {
+	const prefix = "basic "
+	if len(auth) < len(prefix) || !bytes.EqualFold(auth[:len(prefix)], []byte(prefix)) {
+		return
+	}
+	b, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(auth[len(prefix):])))
+	if err != nil {
+		return
+	}
+	i := bytes.IndexByte(b, ':')
+	if i < 0 {
+		return
+	}
+	return string(b[:i]), string(b[i+1:]), true
+}
+
+// parseHtpasswd 解析htpasswd文件,每行 user:hash
+func parseHtpasswd(content []byte) (interface{}, error) {
+	users := make(map[string]string, 16)
+	for n, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("htpasswd line %d invalid", n+1)
+		}
+		user, hash := line[:i], line[i+1:]
+		if !supportedHash(hash) {
+			log.Printf("htpasswd line %d user [%s] unsupported hash, ignored\n", n+1, user)
+			continue
+		}
+		users[user] = hash
+	}
+	return users, nil
+}
+
+// parseGroupFile 解析组文件,每行 group: user1 user2
+func parseGroupFile(content []byte) (interface{}, error) {
+	groups := make(map[string]map[string]bool, 8)
+	for n, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("group file line %d invalid", n+1)
+		}
+		group := strings.TrimSpace(line[:i])
+		if groups[group] == nil {
+			groups[group] = make(map[string]bool, 8)
+		}
+		for _, u := range strings.Fields(line[i+1:]) {
+			groups[group][u] = true
+		}
+	}
+	return groups, nil
+}
+
+func supportedHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2") || strings.HasPrefix(hash, "{SHA}") || strings.HasPrefix(hash, "$apr1$")
+}
+
+// checkPassword 校验密码,支持 bcrypt($2y$ 等)、{SHA}、$apr1$
+func checkPassword(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		want := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(want)) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		parts := strings.SplitN(hash[len("$apr1$"):], "$", 2)
+		if len(parts) != 2 {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1Crypt(password, parts[0]))) == 1
+	}
+	return false
+}
+
+// apr1Crypt Apache的MD5 crypt实现,返回 $apr1$salt$hash
+func apr1Crypt(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(altSum)
+		} else {
+			h.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		r := md5.New()
+		if i&1 != 0 {
+			r.Write(pw)
+		} else {
+			r.Write(final)
+		}
+		if i%3 != 0 {
+			r.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			r.Write(pw)
+		}
+		if i&1 != 0 {
+			r.Write(final)
+		} else {
+			r.Write(pw)
+		}
+		final = r.Sum(nil)
+	}
+
+	var b strings.Builder
+	b.WriteString(magic + salt + "$")
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return b.String()
+}
+
+// remoteUser 认证通过的用户名
+func remoteUser(ctx *fasthttp.RequestCtx) string {
+	if v, ok := ctx.UserValue(remoteUserKey).(string); ok {
+		return v
+	}
+	return ""
+}
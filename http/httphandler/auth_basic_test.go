@@ -0,0 +1,101 @@
+package httphandler
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestApr1Crypt(t *testing.T) {
+	cases := map[string]string{
+		"secret":                               "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/",
+		"a-much-longer-password-over-16-bytes": "$apr1$12345678$IUMroU4n1lKoUKGfmxVUD/",
+	}
+	for password, want := range cases {
+		salt := want[len("$apr1$") : len("$apr1$")+8]
+		if got := apr1Crypt(password, salt); got != want {
+			t.Errorf("apr1Crypt(%q) = %s, want %s", password, got, want)
+		}
+	}
+}
+
+func basicAuthCtx(user, password string) *fasthttp.RequestCtx {
+	ctx := newTestCtx("127.0.0.1:1234")
+	ctx.Request.SetRequestURI("http://localhost/admin")
+	if len(user) > 0 {
+		ctx.Request.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password)))
+	}
+	return ctx
+}
+
+func TestBasicAuthInterceptor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bc, err := bcrypt.GenerateFromPassword([]byte("bpass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwd := filepath.Join(dir, "htpasswd")
+	ioutil.WriteFile(passwd, []byte("# users\n"+
+		"alice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n"+
+		"bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"+
+		"carol:"+string(bc)+"\n"), 0644)
+	groups := filepath.Join(dir, "groups")
+	ioutil.WriteFile(groups, []byte("admins: bob carol\n"), 0644)
+
+	hi, err := newBasicAuthInterceptor(map[string]string{
+		"htpasswd":            passwd,
+		"users":               "alice",
+		"groups":              "admins",
+		"group_file":          groups,
+		"strip_authorization": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		user, password string
+		status         int
+	}{
+		{"alice", "secret", fasthttp.StatusOK},
+		{"bob", "secret", fasthttp.StatusOK},
+		{"carol", "bpass", fasthttp.StatusOK},
+		{"carol", "bpass", fasthttp.StatusOK},
+		{"alice", "wrong", fasthttp.StatusUnauthorized},
+		{"nobody", "secret", fasthttp.StatusUnauthorized},
+		{"", "", fasthttp.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		ctx := basicAuthCtx(c.user, c.password)
+		ok := hi.PreHandle(ctx)
+		if ok != (c.status == fasthttp.StatusOK) || ctx.Response.StatusCode() != c.status {
+			t.Errorf("%s/%s: ok=%v status=%d, want %d", c.user, c.password, ok, ctx.Response.StatusCode(), c.status)
+		}
+		if ok && (len(ctx.Request.Header.Peek("Authorization")) > 0 || remoteUser(ctx) != c.user) {
+			t.Errorf("%s: authorization not stripped or remote user not set", c.user)
+		}
+		if !ok && len(ctx.Response.Header.Peek("WWW-Authenticate")) == 0 {
+			t.Errorf("%s: WWW-Authenticate missing", c.user)
+		}
+	}
+
+	// 移出组后拒绝访问,文件变更后重新加载
+	ioutil.WriteFile(groups, []byte("admins: carol\n"), 0644)
+	bai := hi.(*basicAuthInterceptor)
+	bai.groupFile.checked = time.Time{}
+	ctx := basicAuthCtx("bob", "secret")
+	if hi.PreHandle(ctx) || ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("bob removed from group: status %d", ctx.Response.StatusCode())
+	}
+}
@@ -0,0 +1,416 @@
+package httphandler
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// jwtClaimsKey 校验通过的JWT声明
+const jwtClaimsKey = "jwt_claims"
+
+// jwtInterceptor 校验Bearer JWT,失败返回401,声明不满足要求返回403
+//
+//	args:
+//	  secret_file:         HS256密钥文件
+//	  key_file:            RS256/ES256公钥或证书PEM文件
+//	  jwks:                JWKS的URL或文件路径
+//	  jwks_cache:          JWKS URL缓存时间,默认10m
+//	  algorithms:          允许的算法,逗号分隔,默认按已配置的密钥类型
+//	  issuer:              允许的iss,逗号分隔
+//	  audience:            允许的aud,逗号分隔,任一匹配即可
+//	  leeway:              exp/nbf允许的时钟误差,默认0
+//	  require:             必须的声明,逗号分隔,name 要求存在,name=value 要求相等或包含
+//	  forward:             转发到后端的声明,逗号分隔 claim:Header
+//	  cookie:              从cookie读取token,Authorization头优先
+//	  strip_authorization: true 时转发前移除Authorization头
+type jwtInterceptor struct {
+	keys       *jwtKeySet
+	algorithms map[string]bool
+	issuers    []string
+	audiences  []string
+	leeway     time.Duration
+	require    []jwtRequirement
+	forward    [][2]string
+	cookie     string
+	strip      bool
+}
+
+type jwtRequirement struct {
+	name  string
+	value string
+}
+
+func newJWTInterceptor(args map[string]string) (HandlerInterceptor, error) {
+	keys, err := newJWTKeySet(args)
+	if err != nil {
+		return nil, err
+	}
+	ji := &jwtInterceptor{
+		keys:      keys,
+		issuers:   argList(args, "issuer"),
+		audiences: argList(args, "audience"),
+		cookie:    strings.TrimSpace(args["cookie"]),
+	}
+	if ji.leeway, err = argDuration(args, "leeway", 0); err != nil {
+		return nil, err
+	}
+	if ji.strip, err = argBool(args, "strip_authorization"); err != nil {
+		return nil, err
+	}
+	algs := argList(args, "algorithms")
+	if len(algs) == 0 {
+		algs = keys.algorithms()
+	}
+	ji.algorithms = make(map[string]bool, len(algs))
+	for _, alg := range algs {
+		if _, ok := jwtAlgorithms[alg]; !ok {
+			return nil, fmt.Errorf("unsupported algorithm:%s", alg)
+		}
+		ji.algorithms[alg] = true
+	}
+	for _, v := range argList(args, "require") {
+		r := jwtRequirement{name: v}
+		if i := strings.IndexByte(v, '='); i > 0 {
+			r = jwtRequirement{name: strings.TrimSpace(v[:i]), value: strings.TrimSpace(v[i+1:])}
+		}
+		ji.require = append(ji.require, r)
+	}
+	for _, v := range argList(args, "forward") {
+		i := strings.IndexByte(v, ':')
+		if i <= 0 || i == len(v)-1 {
+			return nil, fmt.Errorf("forward [%s] must be claim:Header", v)
+		}
+		ji.forward = append(ji.forward, [2]string{strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:])})
+	}
+	return ji, nil
+}
+
+func (ji *jwtInterceptor) PreHandle(ctx *fasthttp.RequestCtx) bool {
+	token := ji.token(ctx)
+	if len(token) == 0 {
+		jwtUnauthorized(ctx, "")
+		return false
+	}
+	claims, err := ji.verify(token, time.Now())
+	if err != nil {
+		log.Printf("[%s] jwt rejected:%v\n", RequestID(ctx), err)
+		jwtUnauthorized(ctx, "invalid_token")
+		return false
+	}
+	for _, r := range ji.require {
+		if !claimMatches(claims[r.name], r.value) {
+			log.Printf("[%s] jwt claim [%s] requirement not met\n", RequestID(ctx), r.name)
+			ErrorPage(ctx, fasthttp.StatusForbidden)
+			ctx.Response.Header.Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+			return false
+		}
+	}
+	ctx.SetUserValue(jwtClaimsKey, claims)
+	// 始终覆盖,避免客户端伪造转发头
+	for _, f := range ji.forward {
+		if v, ok := claims[f[0]]; ok {
+			ctx.Request.Header.Set(f[1], claimString(v))
+		} else {
+			ctx.Request.Header.Del(f[1])
+		}
+	}
+	if ji.strip {
+		ctx.Request.Header.Del("Authorization")
+	}
+	return true
+}
+
+func (ji *jwtInterceptor) PostHandle(ctx *fasthttp.RequestCtx) {
+}
+
+func (ji *jwtInterceptor) AfterCompletion(ctx *fasthttp.RequestCtx) {
+}
+
+func (ji *jwtInterceptor) token(ctx *fasthttp.RequestCtx) string {
+	auth := ctx.Request.Header.Peek("Authorization")
+	const prefix = "bearer "
+	if len(auth) > len(prefix) && bytes.EqualFold(auth[:len(prefix)], []byte(prefix)) {
+		return string(bytes.TrimSpace(auth[len(prefix):]))
+	}
+	if len(ji.cookie) > 0 {
+		return string(ctx.Request.Header.Cookie(ji.cookie))
+	}
+	return ""
+}
+
+func jwtUnauthorized(ctx *fasthttp.RequestCtx, errCode string) {
+	ErrorPage(ctx, fasthttp.StatusUnauthorized)
+	if len(errCode) > 0 {
+		ctx.Response.Header.Set("WWW-Authenticate", fmt.Sprintf("Bearer error=%q", errCode))
+	} else {
+		ctx.Response.Header.Set("WWW-Authenticate", "Bearer")
+	}
+}
+
+// verify 校验签名与 exp/nbf/iss/aud,返回声明
+func (ji *jwtInterceptor) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header:%v", err)
+	}
+	if !ji.algorithms[header.Alg] {
+		return nil, fmt.Errorf("algorithm %s not allowed", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return nil, fmt.Errorf("signature:%v", err)
+	}
+	if !ji.keys.verify(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, fmt.Errorf("signature invalid")
+	}
+
+	claims := make(map[string]interface{}, 8)
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims:%v", err)
+	}
+	if exp, ok := claimTime(claims["exp"]); ok && now.After(exp.Add(ji.leeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claimTime(claims["nbf"]); ok && now.Add(ji.leeway).Before(nbf) {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+	if len(ji.issuers) > 0 {
+		iss, _ := claims["iss"].(string)
+		if !containsString(ji.issuers, iss) {
+			return nil, fmt.Errorf("issuer [%s] not allowed", iss)
+		}
+	}
+	if len(ji.audiences) > 0 && !audienceMatches(claims["aud"], ji.audiences) {
+		return nil, fmt.Errorf("audience not allowed")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+func claimTime(v interface{}) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+func audienceMatches(aud interface{}, allowed []string) bool {
+	switch v := aud.(type) {
+	case string:
+		return containsString(allowed, v)
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && containsString(allowed, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimMatches value为空时要求声明存在,否则要求相等、数组包含或空格分隔的字符串包含(如scope)
+func claimMatches(claim interface{}, value string) bool {
+	if claim == nil {
+		return false
+	}
+	if len(value) == 0 {
+		return true
+	}
+	switch v := claim.(type) {
+	case string:
+		return v == value || containsString(strings.Fields(v), value)
+	case []interface{}:
+		for _, e := range v {
+			if claimString(e) == value {
+				return true
+			}
+		}
+		return false
+	}
+	return claimString(claim) == value
+}
+
+// claimString 声明转为字符串,数组以逗号连接
+func claimString(v interface{}) string {
+	switch c := v.(type) {
+	case string:
+		return c
+	case json.Number:
+		return c.String()
+	case []interface{}:
+		list := make([]string, 0, len(c))
+		for _, e := range c {
+			list = append(list, claimString(e))
+		}
+		return strings.Join(list, ",")
+	case nil:
+		return ""
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// JWTClaims 当前请求校验通过的JWT声明,未校验时为nil
+func JWTClaims(ctx *fasthttp.RequestCtx) map[string]interface{} {
+	claims, _ := ctx.UserValue(jwtClaimsKey).(map[string]interface{})
+	return claims
+}
+
+// jwtAlgorithms 支持的算法及其密钥类型
+var jwtAlgorithms = map[string]string{
+	"HS256": "oct",
+	"RS256": "RSA",
+	"ES256": "EC",
+}
+
+// jwtKey 校验签名的密钥,kty 为 oct/RSA/EC
+type jwtKey struct {
+	kid string
+	kty string
+	key interface{}
+}
+
+func (k *jwtKey) verify(alg string, signed, sig []byte) bool {
+	if jwtAlgorithms[alg] != k.kty {
+		return false
+	}
+	digest := sha256.Sum256(signed)
+	switch key := k.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	}
+	return false
+}
+
+// jwtKeySet 本地密钥与JWKS
+type jwtKeySet struct {
+	local []*jwtKey
+	jwks  *jwksSource
+}
+
+func newJWTKeySet(args map[string]string) (*jwtKeySet, error) {
+	ks := &jwtKeySet{}
+	if file := strings.TrimSpace(args["secret_file"]); len(file) > 0 {
+		secret, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		secret = bytes.TrimSpace(secret)
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("secret_file [%s] is empty", file)
+		}
+		ks.local = append(ks.local, &jwtKey{kty: "oct", key: secret})
+	}
+	if file := strings.TrimSpace(args["key_file"]); len(file) > 0 {
+		key, err := loadPublicKey(file)
+		if err != nil {
+			return nil, err
+		}
+		ks.local = append(ks.local, key)
+	}
+	if src := strings.TrimSpace(args["jwks"]); len(src) > 0 {
+		ttl, err := argDuration(args, "jwks_cache", 10*time.Minute)
+		if err != nil {
+			return nil, err
+		}
+		if ks.jwks, err = newJWKSSource(src, ttl); err != nil {
+			return nil, err
+		}
+	}
+	if len(ks.local) == 0 && ks.jwks == nil {
+		return nil, fmt.Errorf("one of secret_file, key_file, jwks is required")
+	}
+	return ks, nil
+}
+
+// algorithms 按已配置的密钥类型推断允许的算法,JWKS允许RS256与ES256
+func (ks *jwtKeySet) algorithms() []string {
+	var algs []string
+	for _, k := range ks.local {
+		for alg, kty := range jwtAlgorithms {
+			if kty == k.kty && !containsString(algs, alg) {
+				algs = append(algs, alg)
+			}
+		}
+	}
+	if ks.jwks != nil {
+		for _, alg := range []string{"RS256", "ES256"} {
+			if !containsString(algs, alg) {
+				algs = append(algs, alg)
+			}
+		}
+	}
+	return algs
+}
+
+func (ks *jwtKeySet) verify(alg, kid string, signed, sig []byte) bool {
+	for _, k := range ks.local {
+		if k.verify(alg, signed, sig) {
+			return true
+		}
+	}
+	if ks.jwks == nil {
+		return false
+	}
+	for _, k := range ks.jwks.keys(kid) {
+		if (len(kid) == 0 || k.kid == kid) && k.verify(alg, signed, sig) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+package httphandler
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// signJWT 测试用签名,key 为 []byte/*rsa.PrivateKey/*ecdsa.PrivateKey
+func signJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(body)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + b64(sig)
+}
+
+func jwtCtx(token string) *fasthttp.RequestCtx {
+	ctx := newTestCtx("127.0.0.1:1234")
+	ctx.Request.SetRequestURI("http://localhost/api")
+	if len(token) > 0 {
+		ctx.Request.Header.Set("Authorization", "Bearer "+token)
+	}
+	ctx.Request.Header.Set("X-User", "spoofed")
+	return ctx
+}
+
+func TestJWTInterceptor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := []byte("hs-secret")
+	secretFile := filepath.Join(dir, "secret")
+	ioutil.WriteFile(secretFile, append(secret, '\n'), 0600)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	keyFile := filepath.Join(dir, "rsa.pem")
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"EC","kid":"ec1","crv":"P-256","x":"%s","y":"%s"}]}`,
+		b64(ecKey.X.Bytes()), b64(ecKey.Y.Bytes()))
+	jwksFile := filepath.Join(dir, "jwks.json")
+	ioutil.WriteFile(jwksFile, []byte(jwks), 0644)
+
+	hi, err := newJWTInterceptor(map[string]string{
+		"secret_file": secretFile,
+		"key_file":    keyFile,
+		"jwks":        jwksFile,
+		"algorithms":  "HS256,RS256,ES256",
+		"issuer":      "https://idp.test",
+		"audience":    "api",
+		"require":     "sub,scope=write",
+		"forward":     "sub:X-User",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": "https://idp.test", "aud": []string{"other", "api"},
+			"sub": "u1", "scope": "read write", "exp": now + 60, "nbf": now - 60,
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	cases := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"hs256", signJWT(t, "HS256", "", secret, claims(nil)), fasthttp.StatusOK},
+		{"rs256", signJWT(t, "RS256", "", rsaKey, claims(nil)), fasthttp.StatusOK},
+		{"es256 jwks", signJWT(t, "ES256", "ec1", ecKey, claims(nil)), fasthttp.StatusOK},
+		{"missing", "", fasthttp.StatusUnauthorized},
+		{"wrong secret", signJWT(t, "HS256", "", []byte("other"), claims(nil)), fasthttp.StatusUnauthorized},
+		{"unknown kid", signJWT(t, "ES256", "ec2", ecKey, claims(nil)), fasthttp.StatusUnauthorized},
+		{"expired", signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"exp": now - 10})), fasthttp.StatusUnauthorized},
+		{"not before", signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"nbf": now + 60})), fasthttp.StatusUnauthorized},
+		{"issuer", signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"iss": "evil"})), fasthttp.StatusUnauthorized},
+		{"audience", signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"aud": "web"})), fasthttp.StatusUnauthorized},
+		{"scope", signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"scope": "read"})), fasthttp.StatusForbidden},
+		{"alg none", b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"u1"}`)) + ".", fasthttp.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		ctx := jwtCtx(c.token)
+		ok := hi.PreHandle(ctx)
+		if ok != (c.status == fasthttp.StatusOK) || ctx.Response.StatusCode() != c.status {
+			t.Errorf("%s: ok=%v status=%d, want %d", c.name, ok, ctx.Response.StatusCode(), c.status)
+			continue
+		}
+		if ok && (string(ctx.Request.Header.Peek("X-User")) != "u1" || JWTClaims(ctx)["sub"] != "u1") {
+			t.Errorf("%s: claims not forwarded", c.name)
+		}
+	}
+}
+
+func TestJWKSURL(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	fetches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		fmt.Fprintf(w, `{"keys":[{"kty":"EC","kid":"k1","use":"sig","crv":"P-256","x":"%s","y":"%s"}]}`,
+			b64(ecKey.X.Bytes()), b64(ecKey.Y.Bytes()))
+	}))
+	defer ts.Close()
+
+	hi, err := newJWTInterceptor(map[string]string{"jwks": ts.URL, "jwks_cache": "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		ctx := jwtCtx(signJWT(t, "ES256", "k1", ecKey, map[string]interface{}{"sub": "u1"}))
+		if !hi.PreHandle(ctx) {
+			t.Fatalf("request %d rejected: %d", i, ctx.Response.StatusCode())
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("jwks fetched %d times, want 1", fetches)
+	}
+}
+
+func TestJWKSSourceRefresh(t *testing.T) {
+	var fetches int32
+	var release chan struct{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&fetches, 1)
+		if release != nil {
+			<-release
+		}
+		fmt.Fprintf(w, `{"keys":[{"kty":"oct","kid":"k%d","k":"c2VjcmV0"}]}`, n)
+	}))
+	defer ts.Close()
+
+	js, err := newJWKSSource(ts.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setAge := func(d time.Duration) {
+		atomic.StoreInt64(&js.fetched, time.Now().Add(-d).UnixNano())
+	}
+
+	// 缓存过期时后台获取,请求使用已缓存的密钥而不等待
+	release = make(chan struct{})
+	setAge(2 * time.Hour)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if keys := js.keys("k1"); !hasKid(keys, "k1") {
+			t.Fatalf("cached keys not used: %v", keys)
+		}
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("request blocked by refresh for %v", time.Since(start))
+	}
+	close(release)
+	for i := 0; i < 100 && !hasKid(js.keys(""), "k2"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Fatalf("background refresh fetched %d times, want 2", n)
+	}
+
+	// 并发请求未知kid时只获取一次
+	release = nil
+	setAge(time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			js.keys("k3")
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 3 || !hasKid(js.keys("k3"), "k3") {
+		t.Errorf("unknown kid fetched %d times, want 3", n)
+	}
+}
@@ -0,0 +1,256 @@
+package httphandler
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+const (
+	// authCacheSize 认证结果缓存的最大条目数
+	authCacheSize = 10000
+)
+
+// authRequestInterceptor 向认证服务发送子请求,2xx放行,401/403返回认证服务的响应,其他结果返回500
+// 子请求携带 X-Original-URI、X-Original-Method 与配置的请求头
+type authRequestInterceptor struct {
+	ac        *config.AuthRequestConfig
+	uc        *config.UpstreamConfig
+	upstreams *UpstreamRegistry
+	timeout   time.Duration
+	headers   []string
+	cacheKey  []string
+	// shared 配置了cache_key,缓存的决定不区分原始请求的方法与URI
+	shared bool
+	cache  *authCache
+}
+
+// addAuthRequestInterceptors 为配置了 auth_request 的location追加认证拦截器
+func addAuthRequestInterceptors(sc *config.ServerConfig, m map[*config.LocationConfig][]HandlerInterceptor, upstreams *UpstreamRegistry) error {
+	for i := range sc.Hosts {
+		h := &sc.Hosts[i]
+		for j := range h.Locations {
+			lc := &h.Locations[j]
+			if len(strings.TrimSpace(lc.AuthRequest.Upstream)) == 0 {
+				continue
+			}
+			ari, err := newAuthRequestInterceptor(&lc.AuthRequest, upstreams)
+			if err != nil {
+				return fmt.Errorf("host %s location %s auth_request %v", h.Host, lc.Pattern, err)
+			}
+			m[lc] = append(m[lc], ari)
+		}
+	}
+	return nil
+}
+
+func newAuthRequestInterceptor(ac *config.AuthRequestConfig, upstreams *UpstreamRegistry) (*authRequestInterceptor, error) {
+	uc := upstreams.Config(ac.Upstream)
+	if uc == nil {
+		return nil, fmt.Errorf("upstream [%s] not found", ac.Upstream)
+	}
+	ari := &authRequestInterceptor{
+		ac:        ac,
+		uc:        uc,
+		upstreams: upstreams,
+		headers:   ac.Headers,
+		cacheKey:  ac.CacheKey,
+	}
+	if len(ari.headers) == 0 {
+		ari.headers = []string{"Authorization", "Cookie"}
+	}
+	if len(ari.cacheKey) == 0 {
+		ari.cacheKey = ari.headers
+	} else {
+		ari.shared = true
+	}
+	switch {
+	case ac.Timeout > 0:
+		ari.timeout = time.Duration(ac.Timeout) * time.Millisecond
+	case uc.Timeout > 0:
+		ari.timeout = time.Duration(uc.Timeout) * time.Millisecond
+	default:
+		ari.timeout = time.Duration(config.DefaultRequestTimeout) * time.Millisecond
+	}
+	if ac.CacheTTL > 0 {
+		ari.cache = newAuthCache(time.Duration(ac.CacheTTL)*time.Millisecond, authCacheSize)
+	}
+	return ari, nil
+}
+
+func (ari *authRequestInterceptor) PreHandle(ctx *fasthttp.RequestCtx) bool {
+	path := ExpandVariables(ctx, ari.ac.Path)
+	if len(path) == 0 {
+		path = "/"
+	}
+	var key string
+	if ari.cache != nil {
+		key = ari.key(ctx, path)
+		if r := ari.cache.get(key); r != nil {
+			return ari.apply(ctx, r)
+		}
+	}
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	method := strings.ToUpper(strings.TrimSpace(ari.ac.Method))
+	if len(method) == 0 {
+		method = fasthttp.MethodGet
+	}
+	req.Header.SetMethod(method)
+	req.SetRequestURI(path)
+	req.Header.SetHostBytes(ctx.Request.Host())
+	req.Header.SetBytesV("X-Original-URI", ctx.URI().RequestURI())
+	req.Header.SetBytesV("X-Original-Method", ctx.Method())
+	for _, h := range ari.headers {
+		if v := ctx.Request.Header.Peek(h); len(v) > 0 {
+			req.Header.SetBytesV(h, v)
+		}
+	}
+
+	upstream, err := ari.upstreams.Get(ari.uc)
+	if err == nil {
+		err = upstream.DoTimeoutFrom(req, resp, ctx.RemoteAddr(), ctx.LocalAddr(), ari.timeout)
+	}
+	if err != nil {
+		log.Printf("[%s] auth_request upstream[%s] error:%v\n", RequestID(ctx), ari.uc.ID, err)
+		ErrorPage(ctx, fasthttp.StatusInternalServerError)
+		return false
+	}
+	r := ari.result(resp)
+	if r == nil {
+		log.Printf("[%s] auth_request upstream[%s] unexpected status %d\n", RequestID(ctx), ari.uc.ID, resp.StatusCode())
+		ErrorPage(ctx, fasthttp.StatusInternalServerError)
+		return false
+	}
+	if ari.cache != nil {
+		ari.cache.put(key, r)
+	}
+	return ari.apply(ctx, r)
+}
+
+func (ari *authRequestInterceptor) PostHandle(ctx *fasthttp.RequestCtx) {
+}
+
+func (ari *authRequestInterceptor) AfterCompletion(ctx *fasthttp.RequestCtx) {
+}
+
+// key 缓存key,包含子请求路径与配置的请求头,使用摘要避免保存凭据原文
+// 默认还包含原始请求的方法与URI,认证服务可按URI作出不同决定;配置cache_key时同一凭据的决定在URI之间共享
+func (ari *authRequestInterceptor) key(ctx *fasthttp.RequestCtx, path string) string {
+	h := sha256.New()
+	h.Write([]byte(path))
+	if !ari.shared {
+		h.Write([]byte{0})
+		h.Write(ctx.Method())
+		h.Write([]byte{0})
+		h.Write(ctx.URI().RequestURI())
+	}
+	for _, name := range ari.cacheKey {
+		h.Write([]byte{0})
+		h.Write(ctx.Request.Header.Peek(name))
+	}
+	return string(h.Sum(nil))
+}
+
+// authResult 认证结果,allowed 时 headers 为复制到代理请求的头,否则 deny 为认证服务的响应
+type authResult struct {
+	allowed bool
+	headers [][2]string
+	deny    *fasthttp.Response
+	expires time.Time
+}
+
+func (ari *authRequestInterceptor) result(resp *fasthttp.Response) *authResult {
+	status := resp.StatusCode()
+	switch {
+	case status >= 200 && status < 300:
+		r := &authResult{allowed: true}
+		for _, h := range ari.ac.ResponseHeaders {
+			r.headers = append(r.headers, [2]string{h, string(resp.Header.Peek(h))})
+		}
+		return r
+	case status == fasthttp.StatusUnauthorized || status == fasthttp.StatusForbidden:
+		deny := &fasthttp.Response{}
+		resp.CopyTo(deny)
+		deny.Header.ResetConnectionClose()
+		return &authResult{deny: deny}
+	}
+	return nil
+}
+
+func (ari *authRequestInterceptor) apply(ctx *fasthttp.RequestCtx, r *authResult) bool {
+	if !r.allowed {
+		r.deny.CopyTo(&ctx.Response)
+		return false
+	}
+	// 认证响应中没有的头同样移除,避免客户端伪造
+	for _, h := range r.headers {
+		if len(h[1]) > 0 {
+			ctx.Request.Header.Set(h[0], h[1])
+		} else {
+			ctx.Request.Header.Del(h[0])
+		}
+	}
+	return true
+}
+
+// authCache 认证结果缓存,超过容量时先清理过期条目,仍不足则随机淘汰
+type authCache struct {
+	ttl     time.Duration
+	size    int
+	lock    sync.Mutex
+	entries map[string]*authResult
+}
+
+func newAuthCache(ttl time.Duration, size int) *authCache {
+	return &authCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*authResult, 64),
+	}
+}
+
+func (c *authCache) get(key string) *authResult {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	r, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(r.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return r
+}
+
+func (c *authCache) put(key string, r *authResult) {
+	now := time.Now()
+	r.expires = now.Add(c.ttl)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.entries) >= c.size {
+		for k, v := range c.entries {
+			if now.After(v.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = r
+}
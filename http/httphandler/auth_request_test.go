@@ -0,0 +1,115 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+func TestAuthRequestInterceptor(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path != "/verify" || !strings.HasPrefix(r.Header.Get("X-Original-URI"), "/api/") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("X-Original-URI") == "/api/admin" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.Header.Get("Authorization") {
+		case "good":
+			w.Header().Set("X-Auth-User", "u1")
+			w.WriteHeader(http.StatusNoContent)
+		case "redirect":
+			w.WriteHeader(http.StatusFound)
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="auth"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("login required"))
+		}
+	}))
+	defer ts.Close()
+
+	upstreams := NewUpstreamRegistry([]config.UpstreamConfig{
+		{ID: "auth", Servers: []string{strings.TrimPrefix(ts.URL, "http://")}},
+	})
+	ari, err := newAuthRequestInterceptor(&config.AuthRequestConfig{
+		Upstream:        "auth",
+		Path:            "/verify",
+		ResponseHeaders: []string{"X-Auth-User"},
+		CacheTTL:        60000,
+	}, upstreams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newURICtx := func(uri, auth string) *fasthttp.RequestCtx {
+		ctx := newTestCtx("127.0.0.1:1234")
+		ctx.Request.SetRequestURI("http://localhost" + uri)
+		ctx.Request.Header.Set("Authorization", auth)
+		ctx.Request.Header.Set("X-Auth-User", "spoofed")
+		return ctx
+	}
+	newCtx := func(auth string) *fasthttp.RequestCtx {
+		return newURICtx("/api/orders", auth)
+	}
+
+	for i := 0; i < 2; i++ {
+		ctx := newCtx("good")
+		if !ari.PreHandle(ctx) {
+			t.Fatalf("allowed request rejected: %d", ctx.Response.StatusCode())
+		}
+		if got := string(ctx.Request.Header.Peek("X-Auth-User")); got != "u1" {
+			t.Errorf("X-Auth-User = %q, want u1", got)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("auth service called %d times, want 1 (cached)", calls)
+	}
+	// 默认缓存key包含原始请求的方法与URI,其他URI的决定不复用
+	if ctx := newURICtx("/api/admin", "good"); ari.PreHandle(ctx) || ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("cached decision reused for another uri: %d", ctx.Response.StatusCode())
+	}
+
+	// 配置cache_key时决定在URI之间共享
+	shared, err := newAuthRequestInterceptor(&config.AuthRequestConfig{
+		Upstream: "auth",
+		Path:     "/verify",
+		CacheTTL: 60000,
+		CacheKey: []string{"Authorization"},
+	}, upstreams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx := newCtx("good"); !shared.PreHandle(ctx) {
+		t.Fatalf("allowed request rejected: %d", ctx.Response.StatusCode())
+	}
+	if ctx := newURICtx("/api/admin", "good"); !shared.PreHandle(ctx) {
+		t.Errorf("cache_key decision not shared: %d", ctx.Response.StatusCode())
+	}
+
+	ctx := newCtx("bad")
+	if ari.PreHandle(ctx) {
+		t.Fatal("denied request allowed")
+	}
+	if ctx.Response.StatusCode() != fasthttp.StatusUnauthorized ||
+		string(ctx.Response.Body()) != "login required" ||
+		len(ctx.Response.Header.Peek("WWW-Authenticate")) == 0 {
+		t.Errorf("auth response not propagated: %d %q", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	ctx = newCtx("redirect")
+	if ari.PreHandle(ctx) || ctx.Response.StatusCode() != fasthttp.StatusInternalServerError {
+		t.Errorf("unexpected auth status: got %d, want 500", ctx.Response.StatusCode())
+	}
+
+	if _, err = newAuthRequestInterceptor(&config.AuthRequestConfig{Upstream: "missing"}, upstreams); err == nil {
+		t.Error("unknown upstream accepted")
+	}
+}
@@ -0,0 +1,229 @@
+package httphandler
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// corsInterceptor 跨域策略,在代理处应答预检请求,并为实际请求的响应添加跨域头
+// 应配置在认证类拦截器之前,预检请求不携带凭据,且认证失败的响应同样需要跨域头浏览器才能读取
+//
+//	args:
+//	  origins:        允许的来源,逗号分隔: *、https://app.example.com、https://*.example.com(子域名)、~正则(匹配完整来源)
+//	  methods:        允许的方法,默认 GET,HEAD,POST
+//	  headers:        允许的请求头,为空时允许预检请求中的全部请求头
+//	  expose_headers: 允许浏览器读取的响应头
+//	  credentials:    true 时允许携带凭据,响应中使用请求的Origin;不能与 origins: * 同时使用
+//	  max_age:        预检结果缓存时间,如 10m 或毫秒数
+type corsInterceptor struct {
+	any      bool
+	exact    map[string]bool
+	wildcard []corsWildcard
+	regexps  []*regexp.Regexp
+
+	methods       []string
+	allowMethods  string
+	allowHeaders  string
+	exposeHeaders string
+	credentials   bool
+	maxAge        string
+}
+
+// corsWildcard 子域名通配,scheme为空时匹配任意协议
+type corsWildcard struct {
+	scheme string
+	suffix string
+}
+
+func newCORSInterceptor(args map[string]string) (HandlerInterceptor, error) {
+	ci := &corsInterceptor{
+		exact:         make(map[string]bool, 4),
+		allowHeaders:  strings.Join(argList(args, "headers"), ", "),
+		exposeHeaders: strings.Join(argList(args, "expose_headers"), ", "),
+	}
+	origins := argList(args, "origins")
+	if len(origins) == 0 {
+		return nil, fmt.Errorf("origins is required")
+	}
+	for _, o := range origins {
+		switch {
+		case o == "*":
+			ci.any = true
+		case strings.HasPrefix(o, "~"):
+			// 匹配完整来源,避免未锚定的正则匹配到 https://app.example.com.evil.com
+			re, err := regexp.Compile("^(?:" + o[1:] + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid origin regexp %s:%v", o, err)
+			}
+			ci.regexps = append(ci.regexps, re)
+		case strings.Contains(o, "*"):
+			w := corsWildcard{}
+			host := o
+			if i := strings.Index(o, "://"); i >= 0 {
+				w.scheme, host = strings.ToLower(o[:i]), o[i+3:]
+			}
+			if !strings.HasPrefix(host, "*.") || strings.Contains(host[1:], "*") {
+				return nil, fmt.Errorf("invalid origin wildcard:%s", o)
+			}
+			w.suffix = strings.ToLower(host[1:])
+			ci.wildcard = append(ci.wildcard, w)
+		default:
+			ci.exact[strings.ToLower(o)] = true
+		}
+	}
+	ci.methods = argList(args, "methods")
+	if len(ci.methods) == 0 {
+		ci.methods = []string{fasthttp.MethodGet, fasthttp.MethodHead, fasthttp.MethodPost}
+	}
+	for i, m := range ci.methods {
+		ci.methods[i] = strings.ToUpper(m)
+	}
+	ci.allowMethods = strings.Join(ci.methods, ", ")
+	var err error
+	if ci.credentials, err = argBool(args, "credentials"); err != nil {
+		return nil, err
+	}
+	// 允许任意来源携带凭据等同于关闭同源策略
+	if ci.any && ci.credentials {
+		return nil, fmt.Errorf("origins * cannot be used with credentials")
+	}
+	maxAge, err := argDuration(args, "max_age", 0)
+	if err != nil {
+		return nil, err
+	}
+	if maxAge > 0 {
+		ci.maxAge = strconv.FormatInt(int64(maxAge/time.Second), 10)
+	}
+	return ci, nil
+}
+
+func (ci *corsInterceptor) PreHandle(ctx *fasthttp.RequestCtx) bool {
+	origin := ctx.Request.Header.Peek("Origin")
+	if len(origin) == 0 || !ctx.IsOptions() {
+		return true
+	}
+	method := ctx.Request.Header.Peek("Access-Control-Request-Method")
+	if len(method) == 0 {
+		// 非预检的OPTIONS请求按实际请求处理
+		return true
+	}
+	if !ci.allowed(string(origin)) || !ci.allowedMethod(string(method)) {
+		log.Printf("[%s] cors preflight from [%s] %s denied for %s\n", RequestID(ctx), origin, method, ctx.Path())
+		ErrorPage(ctx, fasthttp.StatusForbidden)
+		ci.writeVary(ctx)
+		return false
+	}
+	ctx.Response.Reset()
+	ctx.Response.SetStatusCode(fasthttp.StatusNoContent)
+	ci.writeOrigin(ctx, origin)
+	ctx.Response.Header.Set("Access-Control-Allow-Methods", ci.allowMethods)
+	if len(ci.allowHeaders) > 0 {
+		ctx.Response.Header.Set("Access-Control-Allow-Headers", ci.allowHeaders)
+	} else if h := ctx.Request.Header.Peek("Access-Control-Request-Headers"); len(h) > 0 {
+		ctx.Response.Header.SetBytesV("Access-Control-Allow-Headers", h)
+		ctx.Response.Header.Add("Vary", "Access-Control-Request-Headers")
+	}
+	if len(ci.maxAge) > 0 {
+		ctx.Response.Header.Set("Access-Control-Max-Age", ci.maxAge)
+	}
+	return false
+}
+
+func (ci *corsInterceptor) PostHandle(ctx *fasthttp.RequestCtx) {
+}
+
+// AfterCompletion 后续拦截器拒绝请求时同样调用,错误响应也带有跨域头
+func (ci *corsInterceptor) AfterCompletion(ctx *fasthttp.RequestCtx) {
+	origin := ctx.Request.Header.Peek("Origin")
+	if len(origin) == 0 {
+		return
+	}
+	// 由代理统一处理,覆盖后端返回的跨域头,不允许的来源移除后端返回的跨域头
+	if !ci.allowed(string(origin)) {
+		ctx.Response.Header.Del("Access-Control-Allow-Origin")
+		ctx.Response.Header.Del("Access-Control-Allow-Credentials")
+		ctx.Response.Header.Del("Access-Control-Expose-Headers")
+		ci.writeVary(ctx)
+		return
+	}
+	ci.writeOrigin(ctx, origin)
+	if len(ci.exposeHeaders) > 0 {
+		ctx.Response.Header.Set("Access-Control-Expose-Headers", ci.exposeHeaders)
+	}
+}
+
+func (ci *corsInterceptor) writeOrigin(ctx *fasthttp.RequestCtx, origin []byte) {
+	if ci.any {
+		ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	ctx.Response.Header.SetBytesV("Access-Control-Allow-Origin", origin)
+	ci.writeVary(ctx)
+	if ci.credentials {
+		ctx.Response.Header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// writeVary 响应随Origin变化,允许与拒绝的来源都需要,避免缓存将一种响应用于其他来源
+func (ci *corsInterceptor) writeVary(ctx *fasthttp.RequestCtx) {
+	if ci.any {
+		return
+	}
+	if !bytes.Contains(ctx.Response.Header.Peek("Vary"), []byte("Origin")) {
+		ctx.Response.Header.Add("Vary", "Origin")
+	}
+}
+
+func (ci *corsInterceptor) allowed(origin string) bool {
+	if ci.any {
+		return true
+	}
+	o := strings.ToLower(origin)
+	if ci.exact[o] {
+		return true
+	}
+	if len(ci.wildcard) > 0 {
+		if i := strings.Index(o, "://"); i > 0 {
+			scheme, host := o[:i], o[i+3:]
+			for _, w := range ci.wildcard {
+				if (len(w.scheme) == 0 || w.scheme == scheme) && len(host) > len(w.suffix) &&
+					strings.HasSuffix(host, w.suffix) && validOriginLabel(host[:len(host)-len(w.suffix)]) {
+					return true
+				}
+			}
+		}
+	}
+	for _, re := range ci.regexps {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ci *corsInterceptor) allowedMethod(method string) bool {
+	for _, m := range ci.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// validOriginLabel 通配部分只能是域名标签,防止 https://evil.com/.example.com 之类的来源
+func validOriginLabel(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '-' && c != '.' && (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return s[0] != '.' && s[len(s)-1] != '.'
+}
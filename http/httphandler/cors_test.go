@@ -0,0 +1,132 @@
+package httphandler
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+func corsCtx(method, origin, requestMethod string) *fasthttp.RequestCtx {
+	ctx := newTestCtx("127.0.0.1:1234")
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI("http://localhost/api")
+	if len(origin) > 0 {
+		ctx.Request.Header.Set("Origin", origin)
+	}
+	if len(requestMethod) > 0 {
+		ctx.Request.Header.Set("Access-Control-Request-Method", requestMethod)
+		ctx.Request.Header.Set("Access-Control-Request-Headers", "content-type, x-token")
+	}
+	return ctx
+}
+
+// corsBackend 模拟自行返回跨域头的后端
+type corsBackend struct{}
+
+func (corsBackend) Handle(ctx *fasthttp.RequestCtx) {
+	ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
+	ctx.SetBodyString("ok")
+}
+
+func TestCORSOrigins(t *testing.T) {
+	hi, err := newCORSInterceptor(map[string]string{
+		"origins": `https://app.example.com, https://*.example.org, *.example.net, ~https://[a-z]+\.test\.io, ~^https://api\.test\.dev$`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci := hi.(*corsInterceptor)
+	cases := map[string]bool{
+		"https://app.example.com":              true,
+		"https://APP.example.com":              true,
+		"http://app.example.com":               false,
+		"https://a.b.example.org":              true,
+		"http://a.example.org":                 false,
+		"https://example.org":                  false,
+		"https://evil.com/.example.org":        false,
+		"https://evilexample.org":              false,
+		"http://x.example.net":                 true,
+		"https://web.test.io":                  true,
+		"https://web.test.io.evil.com":         false,
+		"https://evil.com/https://web.test.io": false,
+		"https://api.test.dev":                 true,
+		"https://app.example.com.attack.com":   false,
+	}
+	for origin, want := range cases {
+		if got := ci.allowed(origin); got != want {
+			t.Errorf("%s: allowed=%v, want %v", origin, got, want)
+		}
+	}
+
+	for _, args := range []map[string]string{
+		{},
+		{"origins": "~("},
+		{"origins": "https://a.*.com"},
+		{"origins": "*", "credentials": "maybe"},
+		{"origins": "*", "credentials": "true"},
+	} {
+		if _, err := newCORSInterceptor(args); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+}
+
+func TestCORSInterceptor(t *testing.T) {
+	hi, err := newCORSInterceptor(map[string]string{
+		"origins":        "https://*.example.com",
+		"methods":        "get,put",
+		"expose_headers": "X-Total-Count",
+		"credentials":    "true",
+		"max_age":        "10m",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := corsCtx(fasthttp.MethodOptions, "https://app.example.com", fasthttp.MethodPut)
+	if hi.PreHandle(ctx) {
+		t.Fatal("preflight forwarded")
+	}
+	h := &ctx.Response.Header
+	if ctx.Response.StatusCode() != fasthttp.StatusNoContent ||
+		string(h.Peek("Access-Control-Allow-Origin")) != "https://app.example.com" ||
+		string(h.Peek("Access-Control-Allow-Methods")) != "GET, PUT" ||
+		string(h.Peek("Access-Control-Allow-Headers")) != "content-type, x-token" ||
+		string(h.Peek("Access-Control-Allow-Credentials")) != "true" ||
+		string(h.Peek("Access-Control-Max-Age")) != "600" {
+		t.Errorf("preflight response: %d %s", ctx.Response.StatusCode(), h.String())
+	}
+
+	for _, c := range [][2]string{{"https://evil.com", fasthttp.MethodPut}, {"https://app.example.com", fasthttp.MethodDelete}} {
+		ctx = corsCtx(fasthttp.MethodOptions, c[0], c[1])
+		if hi.PreHandle(ctx) || ctx.Response.StatusCode() != fasthttp.StatusForbidden ||
+			string(ctx.Response.Header.Peek("Vary")) != "Origin" {
+			t.Errorf("preflight %s %s: status %d, want 403: %s", c[0], c[1], ctx.Response.StatusCode(), ctx.Response.Header.String())
+		}
+	}
+
+	// 实际请求经过拦截器链后添加跨域头,覆盖后端返回的值
+	lc := &config.LocationConfig{}
+	d := &Dispatch{
+		handlerMappings: []HandlerMapping{&staticMapping{lc: lc, handler: corsBackend{}}},
+		Interceptors:    map[*config.LocationConfig][]HandlerInterceptor{lc: {hi}},
+	}
+	ctx = corsCtx(fasthttp.MethodGet, "https://app.example.com", "")
+	d.DoDispatch(ctx)
+	h = &ctx.Response.Header
+	if string(ctx.Response.Body()) != "ok" ||
+		string(h.Peek("Access-Control-Allow-Origin")) != "https://app.example.com" ||
+		string(h.Peek("Access-Control-Expose-Headers")) != "X-Total-Count" ||
+		string(h.Peek("Vary")) != "Origin" {
+		t.Errorf("actual response: %s", h.String())
+	}
+
+	ctx = corsCtx(fasthttp.MethodGet, "https://evil.com", "")
+	d.DoDispatch(ctx)
+	// 拒绝的响应同样随Origin变化
+	if len(ctx.Response.Header.Peek("Access-Control-Allow-Origin")) > 0 ||
+		string(ctx.Response.Header.Peek("Vary")) != "Origin" {
+		t.Errorf("disallowed origin response: %s", ctx.Response.Header.String())
+	}
+}
@@ -0,0 +1,206 @@
+package httphandler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ztgoto/webrouting/config"
+	"github.com/ztgoto/webrouting/http/client"
+)
+
+// Resolver 域名解析接口,*net.Resolver 满足该接口
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSDiscovery 基于DNS的后端节点发现,定时重新解析并同步节点列表
+type DNSDiscovery struct {
+	upstream *client.Upstream
+	resolver Resolver
+	servers  []string
+	resolve  bool
+	// port 未指定端口的节点使用的默认端口,与连接时一致,HTTPS为443
+	port     string
+	srv      string
+	interval time.Duration
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewDNSDiscovery 在后台解析后端节点并定时重新解析,不阻塞调用方
+// 首次解析完成前使用配置的原始节点,由连接时解析;仅配置SRV时节点列表为空;resolver 为nil时使用 net.DefaultResolver
+func NewDNSDiscovery(uc *config.UpstreamConfig, u *client.Upstream, resolver Resolver) *DNSDiscovery {
+	interval := time.Duration(config.DefaultResolveInterval) * time.Millisecond
+	if uc.ResolveInterval > 0 {
+		interval = time.Duration(uc.ResolveInterval) * time.Millisecond
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	dd := &DNSDiscovery{
+		upstream: u,
+		resolver: resolver,
+		servers:  uc.Servers,
+		resolve:  uc.Resolve,
+		port:     "80",
+		srv:      strings.TrimSpace(uc.SRV),
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+	if uc.TLS.Enable {
+		dd.port = "443"
+	}
+	servers := make([]*client.Server, 0, len(dd.servers))
+	for _, v := range dd.servers {
+		if s := NewUpstreamServer(v); s != nil {
+			servers = append(servers, s)
+		}
+	}
+	if err := u.Replace(servers); err != nil {
+		log.Printf("upstream[%s] %v\n", u.ID, err)
+	}
+	go dd.loop()
+	return dd
+}
+
+// Close 停止定时解析
+func (dd *DNSDiscovery) Close() error {
+	dd.once.Do(func() {
+		close(dd.done)
+	})
+	return nil
+}
+
+// Sync 解析并同步节点,任一记录解析失败时保留当前节点
+func (dd *DNSDiscovery) Sync() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dd.interval)
+	defer cancel()
+
+	specs := make([]serverSpec, 0, 16)
+	if len(dd.srv) > 0 {
+		list, err := lookupSRVSpecs(ctx, dd.resolver, dd.srv)
+		if err != nil {
+			return err
+		}
+		specs = append(specs, list...)
+	}
+	for _, v := range dd.servers {
+		if len(strings.TrimSpace(v)) == 0 {
+			continue
+		}
+		// 配置文件中的节点,与 NewUpstreamServer 一致忽略无效的节点
+		addr, maxConns, weight, err := parseServerSpec(v, false)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if !dd.resolve {
+			specs = append(specs, serverSpec{addr: addr, maxConns: maxConns, weight: weight})
+			continue
+		}
+		list, err := resolveServerSpec(ctx, dd.resolver, addr, dd.port, maxConns, weight)
+		if err != nil {
+			return err
+		}
+		specs = append(specs, list...)
+	}
+	if len(specs) == 0 {
+		return fmt.Errorf("no servers resolved")
+	}
+	syncServers(dd.upstream, specs)
+	return nil
+}
+
+func (dd *DNSDiscovery) loop() {
+	if err := dd.Sync(); err != nil {
+		log.Printf("upstream[%s] resolve:%v\n", dd.upstream.ID, err)
+	}
+	ticker := time.NewTicker(dd.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-dd.done:
+			return
+		case <-ticker.C:
+			if err := dd.Sync(); err != nil {
+				log.Printf("upstream[%s] resolve keep last servers, %v\n", dd.upstream.ID, err)
+			}
+		}
+	}
+}
+
+// resolveServerSpec 将主机名节点解析为全部A/AAAA记录,IP节点原样返回,未指定端口时使用 defaultPort
+// 解析得到的节点保留原主机名,HTTPS连接以其校验证书并作为SNI
+func resolveServerSpec(ctx context.Context, resolver Resolver, addr, defaultPort string, maxConns, weight int) ([]serverSpec, error) {
+	spec := serverSpec{addr: addr, maxConns: maxConns, weight: weight}
+	if strings.HasPrefix(addr, "unix:") {
+		return []serverSpec{spec}, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, defaultPort
+	}
+	if net.ParseIP(host) != nil {
+		return []serverSpec{spec}, nil
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	specs := make([]serverSpec, 0, len(ips))
+	for _, ip := range ips {
+		specs = append(specs, serverSpec{
+			addr:       net.JoinHostPort(ip.IP.String(), port),
+			serverName: host,
+			maxConns:   maxConns,
+			weight:     weight,
+		})
+	}
+	return specs, nil
+}
+
+// lookupSRVSpecs 通过SRV记录获取节点,name 形如 _http._tcp.example.com
+// 只使用priority最小的一组记录,组内按weight分配;其他priority的记录作为备用,
+// 仅在DNS中移除更优先的记录后才会使用,节点不可用时不会自动切换到备用记录
+func lookupSRVSpecs(ctx context.Context, resolver Resolver, name string) ([]serverSpec, error) {
+	_, records, err := resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	specs := make([]serverSpec, 0, len(records))
+	priority := minSRVPriority(records)
+	for _, r := range records {
+		if r.Priority != priority {
+			continue
+		}
+		target := strings.TrimSuffix(r.Target, ".")
+		weight := int(r.Weight)
+		if weight <= 0 {
+			weight = 1
+		}
+		addr := net.JoinHostPort(target, strconv.Itoa(int(r.Port)))
+		specs = append(specs, serverSpec{addr: addr, maxConns: config.DefaultClientMaxConnCount, weight: weight})
+	}
+	return specs, nil
+}
+
+func minSRVPriority(records []*net.SRV) uint16 {
+	var min uint16
+	for i, r := range records {
+		if i == 0 {
+			min = r.Priority
+			continue
+		}
+		if r.Priority < min {
+			min = r.Priority
+		}
+	}
+	return min
+}
@@ -0,0 +1,109 @@
+package httphandler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/ztgoto/webrouting/config"
+	"github.com/ztgoto/webrouting/http/client"
+)
+
+// fakeResolver 进程内DNS替身
+type fakeResolver struct {
+	lock  sync.Mutex
+	hosts map[string][]string
+	srv   map[string][]*net.SRV
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ips, ok := r.hosts[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, v := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(v)})
+	}
+	return addrs, nil
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	records, ok := r.srv[name]
+	if !ok {
+		return "", nil, errors.New("no such host")
+	}
+	return name, records, nil
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	fr := &fakeResolver{
+		hosts: map[string][]string{"api.test": {"10.0.0.1", "fd00::1"}},
+		srv: map[string][]*net.SRV{"_http._tcp.api.test": {
+			{Target: "node1.api.test.", Port: 9000, Weight: 5, Priority: 10},
+			{Target: "backup.api.test.", Port: 9000, Weight: 5, Priority: 20},
+		}},
+	}
+	uc := &config.UpstreamConfig{
+		ID:      "dns",
+		Resolve: true,
+		SRV:     "_http._tcp.api.test",
+		Servers: []string{"api.test:8080;50", "127.0.0.1:8081"},
+	}
+	u := client.NewUpstream(uc.ID, "random")
+	dd := NewDNSDiscovery(uc, u, fr)
+	defer dd.Close()
+
+	// 解析在后台进行,之前使用原始配置
+	if u.Get("api.test:8080") == nil && u.Get("10.0.0.1:8080") == nil {
+		t.Error("configured servers not used before first resolve")
+	}
+	waitServers(t, u, "node1.api.test:9000")
+	if u.Get("backup.api.test:9000") != nil {
+		t.Error("lower priority srv record used")
+	}
+	for _, addr := range []string{"10.0.0.1:8080", "[fd00::1]:8080", "127.0.0.1:8081", "node1.api.test:9000"} {
+		if u.Get(addr) == nil {
+			t.Errorf("server %s not resolved", addr)
+		}
+	}
+	if s := u.Get("node1.api.test:9000"); s != nil && s.Weight != 5 {
+		t.Errorf("srv weight %d", s.Weight)
+	}
+
+	fr.lock.Lock()
+	fr.hosts["api.test"] = []string{"10.0.0.2"}
+	fr.lock.Unlock()
+	dd.Sync()
+	if u.Get("10.0.0.1:8080") != nil || u.Get("10.0.0.2:8080") == nil {
+		t.Error("re-resolve not applied")
+	}
+
+	// 解析失败时保留当前节点
+	fr.lock.Lock()
+	delete(fr.hosts, "api.test")
+	fr.lock.Unlock()
+	if dd.Sync() == nil || u.Get("10.0.0.2:8080") == nil {
+		t.Error("servers changed on resolve error")
+	}
+}
+
+func TestDNSDiscoveryDefaultPort(t *testing.T) {
+	fr := &fakeResolver{hosts: map[string][]string{"api.test": {"10.0.0.1"}}}
+
+	// 未指定端口的节点与连接时一致,HTTPS使用443
+	for port, tls := range map[string]bool{"80": false, "443": true} {
+		uc := &config.UpstreamConfig{ID: "dns", Resolve: true, Servers: []string{"api.test"}}
+		uc.TLS.Enable = tls
+		u := client.NewUpstream(uc.ID, "random")
+		dd := NewDNSDiscovery(uc, u, fr)
+		waitServers(t, u, "10.0.0.1:"+port)
+		dd.Close()
+	}
+}
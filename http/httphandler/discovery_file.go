@@ -0,0 +1,244 @@
+package httphandler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/ztgoto/webrouting/http/client"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// 文件变更后等待的合并时间,避免写入过程中读取到不完整的文件
+	fileDiscoveryDelay = 200 * time.Millisecond
+)
+
+// FileDiscovery 基于文件的后端节点发现,文件变更时同步节点列表
+type FileDiscovery struct {
+	path     string
+	upstream *client.Upstream
+	watcher  *fsnotify.Watcher
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewFileDiscovery 读取节点文件并开始监听变更
+// path 可以是单个文件或目录,目录下的 .json/.yaml/.yml 文件合并为一个节点列表
+func NewFileDiscovery(path string, u *client.Upstream) (*FileDiscovery, error) {
+	fd := &FileDiscovery{
+		path:     filepath.Clean(path),
+		upstream: u,
+		done:     make(chan struct{}),
+	}
+	// 初始文件有误时仍然监听,等待文件修正
+	if err := fd.Sync(); err != nil {
+		log.Printf("upstream[%s] discovery:%v\n", u.ID, err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// 监听所在目录,配置管理工具通常以重命名方式替换文件
+	dir := fd.path
+	if !fd.isDir() {
+		dir = filepath.Dir(fd.path)
+	}
+	if err = watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	fd.watcher = watcher
+	go fd.watch()
+	return fd, nil
+}
+
+// Close 停止监听
+func (fd *FileDiscovery) Close() error {
+	fd.once.Do(func() {
+		close(fd.done)
+	})
+	if fd.watcher != nil {
+		return fd.watcher.Close()
+	}
+	return nil
+}
+
+// Sync 读取节点文件并同步到后端服务组,文件格式错误时保留当前节点
+func (fd *FileDiscovery) Sync() error {
+	specs, err := fd.read()
+	if err != nil {
+		return err
+	}
+	SyncUpstreamServers(fd.upstream, specs)
+	return nil
+}
+
+func (fd *FileDiscovery) isDir() bool {
+	fi, err := os.Stat(fd.path)
+	return err == nil && fi.IsDir()
+}
+
+func (fd *FileDiscovery) read() ([]string, error) {
+	files := []string{fd.path}
+	if fd.isDir() {
+		entries, err := ioutil.ReadDir(fd.path)
+		if err != nil {
+			return nil, err
+		}
+		files = files[:0]
+		for _, v := range entries {
+			if !v.IsDir() && isDiscoveryFile(v.Name()) {
+				files = append(files, filepath.Join(fd.path, v.Name()))
+			}
+		}
+	}
+
+	specs := make([]string, 0, 16)
+	for _, f := range files {
+		content, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		// JSON是YAML的子集,统一按YAML解析
+		list := make([]string, 0, 16)
+		if err = yaml.Unmarshal(content, &list); err != nil {
+			return nil, fmt.Errorf("discovery file [%s]:%v", f, err)
+		}
+		for _, v := range list {
+			if _, _, _, err = ParseServerSpec(v); err != nil {
+				return nil, fmt.Errorf("discovery file [%s]:%v", f, err)
+			}
+		}
+		specs = append(specs, list...)
+	}
+	return specs, nil
+}
+
+func (fd *FileDiscovery) watch() {
+	var timer *time.Timer
+	var fire <-chan time.Time
+	for {
+		select {
+		case <-fd.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case ev, ok := <-fd.watcher.Events:
+			if !ok {
+				return
+			}
+			if !fd.relevant(ev.Name) {
+				continue
+			}
+			if timer == nil {
+				timer = time.NewTimer(fileDiscoveryDelay)
+			} else {
+				timer.Reset(fileDiscoveryDelay)
+			}
+			fire = timer.C
+		case err, ok := <-fd.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("upstream[%s] discovery watch error:%v\n", fd.upstream.ID, err)
+		case <-fire:
+			fire = nil
+			if err := fd.Sync(); err != nil {
+				log.Printf("upstream[%s] discovery keep last servers, %v\n", fd.upstream.ID, err)
+			}
+		}
+	}
+}
+
+func (fd *FileDiscovery) relevant(name string) bool {
+	name = filepath.Clean(name)
+	if name == fd.path {
+		return true
+	}
+	return filepath.Dir(name) == fd.path && isDiscoveryFile(name)
+}
+
+func isDiscoveryFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// SyncUpstreamServers 按节点配置列表同步后端服务组,保留未变化节点的状态
+// 新的节点列表构建完成后一次性替换,列表为空时保留当前节点
+func SyncUpstreamServers(u *client.Upstream, specs []string) {
+	list := make([]serverSpec, 0, len(specs))
+	for _, v := range specs {
+		addr, maxConns, weight, err := ParseServerSpec(v)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		list = append(list, serverSpec{addr: addr, maxConns: maxConns, weight: weight})
+	}
+	syncServers(u, list)
+}
+
+// serverSpec 解析后的节点配置,serverName 为解析为IP前的主机名,用于TLS证书校验与SNI
+type serverSpec struct {
+	addr       string
+	serverName string
+	maxConns   int
+	weight     int
+}
+
+func syncServers(u *client.Upstream, specs []serverSpec) {
+	current := make(map[string]*client.Server, len(specs))
+	for _, s := range u.Servers() {
+		current[s.Addr] = s
+	}
+	servers := make([]*client.Server, 0, len(specs))
+	seen := make(map[string]bool, len(specs))
+	added := make([]string, 0, len(specs))
+	for _, v := range specs {
+		addr := v.addr
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		// 参数未变化时保留原节点及其状态与连接
+		if s, ok := current[addr]; ok && s.MaxConns == v.maxConns && s.Weight == v.weight && s.ServerName == v.serverName {
+			servers = append(servers, s)
+			continue
+		}
+		s := client.NewServer(addr, v.maxConns)
+		s.Weight = v.weight
+		s.ServerName = v.serverName
+		servers = append(servers, s)
+		if _, ok := current[addr]; !ok {
+			added = append(added, addr)
+		}
+	}
+	if len(servers) == 0 {
+		log.Printf("upstream[%s] discovery returned no servers, keep %d current servers\n", u.ID, len(current))
+		return
+	}
+	if err := u.Replace(servers); err != nil {
+		log.Printf("upstream[%s] keep current servers, %v\n", u.ID, err)
+		return
+	}
+	for _, addr := range added {
+		log.Printf("upstream[%s] server[%s] added\n", u.ID, addr)
+	}
+	for addr := range current {
+		if !seen[addr] {
+			log.Printf("upstream[%s] server[%s] removed\n", u.ID, addr)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package httphandler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ztgoto/webrouting/config"
+	"github.com/ztgoto/webrouting/http/client"
+)
+
+func TestFileDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "targets.json")
+	ioutil.WriteFile(file, []byte(`["127.0.0.1:8080;100", "127.0.0.1:8081"]`), 0644)
+
+	u := client.NewUpstream("test", "random")
+	fd, err := NewFileDiscovery(file, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	if len(u.Servers()) != 2 || u.Get("127.0.0.1:8080").MaxConns != 100 {
+		t.Fatalf("initial servers %d", len(u.Servers()))
+	}
+	u.Get("127.0.0.1:8081").SetState(client.ServerDraining)
+
+	ioutil.WriteFile(file, []byte("- 127.0.0.1:8081\n- 127.0.0.1:8082\n"), 0644)
+	waitServers(t, u, "127.0.0.1:8082")
+	if u.Get("127.0.0.1:8080") != nil {
+		t.Error("removed server still present")
+	}
+	if u.Get("127.0.0.1:8081").State() != client.ServerDraining {
+		t.Error("unchanged server state lost")
+	}
+
+	// 格式错误时保留上一次的节点
+	ioutil.WriteFile(file, []byte(`["127.0.0.1:8083;abc"]`), 0644)
+	time.Sleep(4 * fileDiscoveryDelay)
+	if len(u.Servers()) != 2 || u.Get("127.0.0.1:8083") != nil {
+		t.Error("malformed file applied")
+	}
+
+	// 空列表时保留当前节点
+	ioutil.WriteFile(file, []byte(`[]`), 0644)
+	time.Sleep(4 * fileDiscoveryDelay)
+	if len(u.Servers()) != 2 {
+		t.Errorf("empty file applied, %d servers", len(u.Servers()))
+	}
+}
+
+func TestNewUpstreamServerLenient(t *testing.T) {
+	// 配置文件中无效的MaxConnections/Weight使用默认值,节点发现中视为错误
+	s := NewUpstreamServer("127.0.0.1:8080;abc;0")
+	if s == nil || s.Addr != "127.0.0.1:8080" || s.MaxConns != config.DefaultClientMaxConnCount || s.Weight != 1 {
+		t.Fatalf("lenient spec: %+v", s)
+	}
+	// IPv6节点需使用 [addr]:port
+	if addr, _, _, err := ParseServerSpec("[::1]:8080;10;2"); err != nil || addr != "[::1]:8080" {
+		t.Errorf("ipv6 spec: %s %v", addr, err)
+	}
+	if _, _, _, err := ParseServerSpec("::1:8080"); err == nil {
+		t.Error("ipv6 spec without brackets accepted")
+	}
+	if _, _, _, err := ParseServerSpec("127.0.0.1:8080;abc"); err == nil {
+		t.Error("strict spec accepted invalid MaxConnections")
+	}
+	if NewUpstreamServer("::1:8080") != nil {
+		t.Error("invalid addr accepted")
+	}
+}
+
+func waitServers(t *testing.T, u *client.Upstream, addr string) {
+	for i := 0; i < 50; i++ {
+		if u.Get(addr) != nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("server %s not discovered", addr)
+}
@@ -1,6 +1,8 @@
 package httphandler
 
 import (
+	"fmt"
+
 	"github.com/valyala/fasthttp"
 	"github.com/ztgoto/webrouting/config"
 )
@@ -20,6 +22,8 @@ type HandlerMapping interface {
 }
 
 // HandlerInterceptor 拦截器
+// PreHandle 按配置顺序执行,返回false时中止请求;PostHandle 在处理器执行后逆序执行;
+// AfterCompletion 在请求结束时对PreHandle返回true的拦截器逆序执行
 type HandlerInterceptor interface {
 	PreHandle(*fasthttp.RequestCtx) bool
 	PostHandle(*fasthttp.RequestCtx)
@@ -31,6 +35,8 @@ type HandlerExecutionChain struct {
 	interceptorIndex int
 	handler          Handler
 	interceptors     []HandlerInterceptor
+	// location 命中的location,用于查找其拦截器
+	location *config.LocationConfig
 }
 
 func (hec *HandlerExecutionChain) applyPreHandle(ctx *fasthttp.RequestCtx) bool {
@@ -48,7 +54,7 @@ func (hec *HandlerExecutionChain) applyPreHandle(ctx *fasthttp.RequestCtx) bool
 
 func (hec *HandlerExecutionChain) applyPostHandle(ctx *fasthttp.RequestCtx) {
 	if hec.interceptors != nil && len(hec.interceptors) > 0 {
-		for i := len(hec.interceptors); i >= 0; i-- {
+		for i := len(hec.interceptors) - 1; i >= 0; i-- {
 			hi := hec.interceptors[i]
 			hi.PostHandle(ctx)
 		}
@@ -74,6 +80,12 @@ func (hec *HandlerExecutionChain) triggerAfterCompletion(ctx *fasthttp.RequestCt
 // Dispatch 路由分发
 type Dispatch struct {
 	handlerMappings []HandlerMapping
+
+	// RequestID 请求ID处理器,为nil则不生成请求ID
+	RequestID *RequestIDHandler
+
+	// Interceptors 各location的拦截器,由 BuildInterceptors 创建
+	Interceptors map[*config.LocationConfig][]HandlerInterceptor
 }
 
 // DoDispatch 处理器
@@ -82,19 +94,32 @@ func (rd *Dispatch) DoDispatch(ctx *fasthttp.RequestCtx) {
 	// path := string(ctx.Path())
 	// log.Printf("httphost:%s,uri:%s\n", httphost, path)
 
+	if rd.RequestID != nil {
+		rd.RequestID.Apply(ctx)
+		defer rd.RequestID.Echo(ctx)
+	}
+
 	hec := rd.getHandler(ctx)
 
 	if hec == nil {
-		ctx.Response.SetStatusCode(fasthttp.StatusNotFound)
+		ErrorPage(ctx, fasthttp.StatusNotFound)
 		return
 	}
 	handler := hec.handler
+	if hec.interceptors == nil && hec.location != nil {
+		hec.interceptors = rd.Interceptors[hec.location]
+	}
 
+	// 客户端证书校验先于拦截器,未通过的请求不计入限流、不发起认证子请求
+	if !checkClientCert(ctx, hec.location) {
+		return
+	}
 	if !hec.applyPreHandle(ctx) {
 		return
 	}
 	handler.Handle(ctx)
 	hec.applyPostHandle(ctx)
+	hec.triggerAfterCompletion(ctx)
 }
 
 func (rd *Dispatch) getHandler(ctx *fasthttp.RequestCtx) *HandlerExecutionChain {
@@ -109,17 +134,13 @@ func (rd *Dispatch) getHandler(ctx *fasthttp.RequestCtx) *HandlerExecutionChain
 	return nil
 }
 
-// NewDefaultDispathc 创建dispatch
-func NewDefaultDispathc(lc map[string][]*config.LocationConfig) *Dispatch {
-
-	return &Dispatch{
-		handlerMappings: []HandlerMapping{
-			&RoutingHandlerMapping{
-				LocConfig: lc,
-			},
-			&StaticFileHandlerMapping{
-				LocConfig: lc,
-			},
-		},
+// ErrorPage 输出错误页面,启用请求ID时页面中包含请求ID
+func ErrorPage(ctx *fasthttp.RequestCtx, status int) {
+	ctx.Response.SetStatusCode(status)
+	ctx.SetContentType("text/plain; charset=utf-8")
+	body := fmt.Sprintf("%d %s\n", status, fasthttp.StatusMessage(status))
+	if id := RequestID(ctx); len(id) > 0 {
+		body += fmt.Sprintf("Request ID: %s\n", id)
 	}
+	ctx.Response.SetBodyString(body)
 }
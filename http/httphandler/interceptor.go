@@ -0,0 +1,236 @@
+package httphandler
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+// InterceptorFactory 按配置参数创建拦截器
+type InterceptorFactory func(args map[string]string) (HandlerInterceptor, error)
+
+var (
+	interceptorFactories = map[string]InterceptorFactory{
+		"access_log":        newAccessLogInterceptor,
+		"response_header":   newResponseHeaderInterceptor,
+		"basic_auth":        newBasicAuthInterceptor,
+		"jwt":               newJWTInterceptor,
+		"ip_access":         newIPAccessInterceptor,
+		"rate_limit":        newRateLimitInterceptor,
+		"concurrency_limit": newConcurrencyLimitInterceptor,
+		"cors":              newCORSInterceptor,
+	}
+	interceptorLock sync.RWMutex
+)
+
+// RegisterInterceptor 注册拦截器,配置中以name引用,同名时覆盖
+func RegisterInterceptor(name string, factory InterceptorFactory) {
+	if len(name) == 0 || factory == nil {
+		panic("interceptor name and factory are required")
+	}
+	interceptorLock.Lock()
+	interceptorFactories[name] = factory
+	interceptorLock.Unlock()
+}
+
+// NewInterceptor 按配置创建拦截器
+func NewInterceptor(ic *config.InterceptorConfig) (HandlerInterceptor, error) {
+	name := strings.TrimSpace(ic.Name)
+	interceptorLock.RLock()
+	factory, ok := interceptorFactories[name]
+	interceptorLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown interceptor:%s", name)
+	}
+	hi, err := factory(ic.Args)
+	if err != nil {
+		return nil, fmt.Errorf("interceptor %s:%v", name, err)
+	}
+	return hi, nil
+}
+
+// BuildInterceptors 创建监听下各location的拦截器,依次为server、host、location配置的拦截器
+func BuildInterceptors(sc *config.ServerConfig) (map[*config.LocationConfig][]HandlerInterceptor, error) {
+	server, err := newInterceptors(sc.Interceptors)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[*config.LocationConfig][]HandlerInterceptor, 16)
+	for i := range sc.Hosts {
+		h := &sc.Hosts[i]
+		host, err := newInterceptors(h.Interceptors)
+		if err != nil {
+			return nil, fmt.Errorf("host %s %v", h.Host, err)
+		}
+		for j := range h.Locations {
+			lc := &h.Locations[j]
+			loc, err := newInterceptors(lc.Interceptors)
+			if err != nil {
+				return nil, fmt.Errorf("host %s location %s %v", h.Host, lc.Pattern, err)
+			}
+			list := make([]HandlerInterceptor, 0, len(server)+len(host)+len(loc))
+			list = append(list, server...)
+			list = append(list, host...)
+			list = append(list, loc...)
+			if len(list) > 0 {
+				m[lc] = list
+			}
+		}
+	}
+	return m, nil
+}
+
+func newInterceptors(list []config.InterceptorConfig) ([]HandlerInterceptor, error) {
+	his := make([]HandlerInterceptor, 0, len(list))
+	for i := range list {
+		hi, err := NewInterceptor(&list[i])
+		if err != nil {
+			return nil, err
+		}
+		his = append(his, hi)
+	}
+	return his, nil
+}
+
+// argList 逗号分隔的参数列表
+func argList(args map[string]string, key string) []string {
+	var list []string
+	for _, v := range strings.Split(args[key], ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// argBool 布尔参数,未配置时为false
+func argBool(args map[string]string, key string) (bool, error) {
+	v := strings.TrimSpace(args[key])
+	if len(v) == 0 {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s invalid bool:%s", key, v)
+	}
+	return b, nil
+}
+
+// argInt 非负整数参数,未配置时返回def
+func argInt(args map[string]string, key string, def int) (int, error) {
+	v := strings.TrimSpace(args[key])
+	if len(v) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s invalid number:%s", key, v)
+	}
+	return n, nil
+}
+
+// argDuration 时间参数,支持 10s、5m 格式或毫秒数,未配置时返回def
+func argDuration(args map[string]string, key string, def time.Duration) (time.Duration, error) {
+	v := strings.TrimSpace(args[key])
+	if len(v) == 0 {
+		return def, nil
+	}
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s invalid duration:%s", key, v)
+	}
+	return d, nil
+}
+
+// accessLogInterceptor 请求结束时输出访问日志
+type accessLogInterceptor struct{}
+
+func newAccessLogInterceptor(args map[string]string) (HandlerInterceptor, error) {
+	return accessLogInterceptor{}, nil
+}
+
+func (accessLogInterceptor) PreHandle(ctx *fasthttp.RequestCtx) bool {
+	return true
+}
+
+func (accessLogInterceptor) PostHandle(ctx *fasthttp.RequestCtx) {
+}
+
+func (accessLogInterceptor) AfterCompletion(ctx *fasthttp.RequestCtx) {
+	log.Printf("%s \"%s %s\" %d %d %v [%s]\n", ctx.RemoteIP(), ctx.Method(), ctx.RequestURI(),
+		ctx.Response.StatusCode(), len(ctx.Response.Body()), time.Since(ctx.Time()), RequestID(ctx))
+}
+
+// responseHeaderInterceptor 设置响应头,args 为头名称与值,值中可使用变量
+type responseHeaderInterceptor struct {
+	headers map[string]string
+}
+
+func newResponseHeaderInterceptor(args map[string]string) (HandlerInterceptor, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("args is empty")
+	}
+	return &responseHeaderInterceptor{headers: args}, nil
+}
+
+func (h *responseHeaderInterceptor) PreHandle(ctx *fasthttp.RequestCtx) bool {
+	return true
+}
+
+func (h *responseHeaderInterceptor) PostHandle(ctx *fasthttp.RequestCtx) {
+	for k, v := range h.headers {
+		ctx.Response.Header.Set(k, ExpandVariables(ctx, v))
+	}
+}
+
+func (h *responseHeaderInterceptor) AfterCompletion(ctx *fasthttp.RequestCtx) {
+}
+
+// concurrencyLimitInterceptor 限制同时处理的请求数,超出时返回503
+// 配置在server或host时,下属全部location共享同一上限
+//
+//	args:
+//	  max: 最大并发请求数
+type concurrencyLimitInterceptor struct {
+	max    int32
+	active int32
+}
+
+func newConcurrencyLimitInterceptor(args map[string]string) (HandlerInterceptor, error) {
+	max, err := argInt(args, "max", 0)
+	if err != nil {
+		return nil, err
+	}
+	if max == 0 {
+		return nil, fmt.Errorf("max is required")
+	}
+	return &concurrencyLimitInterceptor{max: int32(max)}, nil
+}
+
+func (h *concurrencyLimitInterceptor) PreHandle(ctx *fasthttp.RequestCtx) bool {
+	if atomic.AddInt32(&h.active, 1) > h.max {
+		atomic.AddInt32(&h.active, -1)
+		log.Printf("[%s] concurrency limit %d exceeded for %s\n", RequestID(ctx), h.max, ctx.Path())
+		ErrorPage(ctx, fasthttp.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+func (h *concurrencyLimitInterceptor) PostHandle(ctx *fasthttp.RequestCtx) {
+}
+
+// AfterCompletion 仅在PreHandle通过后调用,释放计数
+func (h *concurrencyLimitInterceptor) AfterCompletion(ctx *fasthttp.RequestCtx) {
+	atomic.AddInt32(&h.active, -1)
+}
@@ -0,0 +1,151 @@
+package httphandler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+// recordInterceptor 记录调用顺序
+type recordInterceptor struct {
+	name   string
+	allow  bool
+	record *[]string
+}
+
+func (r *recordInterceptor) PreHandle(ctx *fasthttp.RequestCtx) bool {
+	*r.record = append(*r.record, "pre:"+r.name)
+	return r.allow
+}
+
+func (r *recordInterceptor) PostHandle(ctx *fasthttp.RequestCtx) {
+	*r.record = append(*r.record, "post:"+r.name)
+}
+
+func (r *recordInterceptor) AfterCompletion(ctx *fasthttp.RequestCtx) {
+	*r.record = append(*r.record, "after:"+r.name)
+}
+
+type recordHandler struct {
+	record *[]string
+}
+
+func (h *recordHandler) Handle(ctx *fasthttp.RequestCtx) {
+	*h.record = append(*h.record, "handle")
+}
+
+type staticMapping struct {
+	lc      *config.LocationConfig
+	handler Handler
+}
+
+func (m *staticMapping) GetHandler(ctx *fasthttp.RequestCtx) *HandlerExecutionChain {
+	return &HandlerExecutionChain{interceptorIndex: -1, handler: m.handler, location: m.lc}
+}
+
+func TestInterceptorChain(t *testing.T) {
+	var record []string
+	lc := &config.LocationConfig{}
+	d := &Dispatch{
+		handlerMappings: []HandlerMapping{&staticMapping{lc: lc, handler: &recordHandler{&record}}},
+		Interceptors: map[*config.LocationConfig][]HandlerInterceptor{
+			lc: {
+				&recordInterceptor{"a", true, &record},
+				&recordInterceptor{"b", true, &record},
+			},
+		},
+	}
+	d.DoDispatch(newTestCtx("127.0.0.1:1234"))
+	want := "pre:a,pre:b,handle,post:b,post:a,after:b,after:a"
+	if got := strings.Join(record, ","); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// b 拒绝时处理器不执行,只对已通过的拦截器调用AfterCompletion
+	record = nil
+	d.Interceptors[lc] = []HandlerInterceptor{
+		&recordInterceptor{"a", true, &record},
+		&recordInterceptor{"b", false, &record},
+		&recordInterceptor{"c", true, &record},
+	}
+	d.DoDispatch(newTestCtx("127.0.0.1:1234"))
+	want = "pre:a,pre:b,after:a"
+	if got := strings.Join(record, ","); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestBuildInterceptors(t *testing.T) {
+	c, err := config.ParseConfig([]byte(`
+http:
+  servers:
+    - listen: ":8080"
+      interceptors: [access_log]
+      hosts:
+        - host: localhost
+          interceptors:
+            - name: response_header
+              args: {"X-Host": "localhost"}
+          locations:
+            - pattern: "/"
+              root: "./"
+            - pattern: "/api"
+              root: "./"
+              interceptors: [access_log]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &c.HTTP.Servers[0]
+	m, err := BuildInterceptors(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(m[&sc.Hosts[0].Locations[0]]); n != 2 {
+		t.Errorf("location 0 interceptors = %d, want 2", n)
+	}
+	if n := len(m[&sc.Hosts[0].Locations[1]]); n != 3 {
+		t.Errorf("location 1 interceptors = %d, want 3", n)
+	}
+
+	sc.Interceptors = append(sc.Interceptors, config.InterceptorConfig{Name: "missing"})
+	if _, err = BuildInterceptors(sc); err == nil {
+		t.Error("unknown interceptor accepted")
+	}
+}
+
+func TestConcurrencyLimitInterceptor(t *testing.T) {
+	hi, err := newConcurrencyLimitInterceptor(map[string]string{"max": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := hi.(*concurrencyLimitInterceptor)
+	if !cli.PreHandle(newTestCtx("127.0.0.1:1234")) {
+		t.Fatal("first request rejected")
+	}
+	ctx := newTestCtx("127.0.0.1:1234")
+	if cli.PreHandle(ctx) || ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Errorf("over limit: status %d", ctx.Response.StatusCode())
+	}
+	cli.AfterCompletion(ctx)
+
+	// 后续拦截器拒绝时同样释放计数
+	var record []string
+	lc := &config.LocationConfig{}
+	d := &Dispatch{
+		handlerMappings: []HandlerMapping{&staticMapping{lc: lc, handler: &recordHandler{&record}}},
+		Interceptors: map[*config.LocationConfig][]HandlerInterceptor{
+			lc: {cli, &recordInterceptor{"deny", false, &record}},
+		},
+	}
+	d.DoDispatch(newTestCtx("127.0.0.1:1234"))
+	if cli.active != 0 {
+		t.Errorf("active = %d, want 0", cli.active)
+	}
+
+	if _, err = newConcurrencyLimitInterceptor(map[string]string{}); err == nil {
+		t.Error("missing max accepted")
+	}
+}
@@ -0,0 +1,200 @@
+package httphandler
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// clientIPKey 经可信代理解析后的客户端IP,$client_ip 变量取值
+const clientIPKey = "client_ip"
+
+// ipAccessInterceptor 按客户端IP的allow/deny规则访问控制,规则按顺序匹配,首个匹配的规则生效
+//
+//	args:
+//	  rules:           规则,逗号分隔,如 "deny 10.0.0.1,allow 10.0.0.0/8,allow 2001:db8::/32,deny all"
+//	  files:           规则文件,逗号分隔,每行一条规则,在rules之后依次匹配,文件变更时自动重新加载
+//	  default:         没有匹配的规则时 allow|deny,默认 allow
+//	  trusted_proxies: 可信代理IP/CIDR,逗号分隔,来源为可信代理时从real_ip_header解析客户端IP
+//	  real_ip_header:  客户端IP请求头,默认 X-Forwarded-For
+type ipAccessInterceptor struct {
+	rules  []ipRule
+	files  []*reloadFile
+	deny   bool
+	realIP *realIPResolver
+}
+
+// ipRule 单条规则,net为nil时匹配全部地址
+type ipRule struct {
+	allow bool
+	net   *net.IPNet
+}
+
+func newIPAccessInterceptor(args map[string]string) (HandlerInterceptor, error) {
+	rules, err := parseIPRules(argList(args, "rules"))
+	if err != nil {
+		return nil, err
+	}
+	iai := &ipAccessInterceptor{rules: rules}
+	for _, file := range argList(args, "files") {
+		f, err := newReloadFile(file, func(content []byte) (interface{}, error) {
+			return parseIPRules(strings.Split(string(content), "\n"))
+		})
+		if err != nil {
+			return nil, err
+		}
+		iai.files = append(iai.files, f)
+	}
+	if len(iai.rules) == 0 && len(iai.files) == 0 {
+		return nil, fmt.Errorf("rules or files is required")
+	}
+	switch v := strings.TrimSpace(args["default"]); v {
+	case "", "allow":
+	case "deny":
+		iai.deny = true
+	default:
+		return nil, fmt.Errorf("invalid default:%s", v)
+	}
+	if iai.realIP, err = newRealIPResolver(args); err != nil {
+		return nil, err
+	}
+	return iai, nil
+}
+
+func (iai *ipAccessInterceptor) PreHandle(ctx *fasthttp.RequestCtx) bool {
+	ip := iai.realIP.resolve(ctx)
+	if iai.allowed(ip) {
+		return true
+	}
+	log.Printf("[%s] client [%s] denied for %s\n", RequestID(ctx), ip, ctx.Path())
+	ErrorPage(ctx, fasthttp.StatusForbidden)
+	return false
+}
+
+func (iai *ipAccessInterceptor) PostHandle(ctx *fasthttp.RequestCtx) {
+}
+
+func (iai *ipAccessInterceptor) AfterCompletion(ctx *fasthttp.RequestCtx) {
+}
+
+func (iai *ipAccessInterceptor) allowed(ip net.IP) bool {
+	if allow, ok := matchIPRules(iai.rules, ip); ok {
+		return allow
+	}
+	for _, f := range iai.files {
+		if allow, ok := matchIPRules(f.Get().([]ipRule), ip); ok {
+			return allow
+		}
+	}
+	return !iai.deny
+}
+
+func matchIPRules(rules []ipRule, ip net.IP) (allow, ok bool) {
+	for _, r := range rules {
+		if r.net == nil || r.net.Contains(ip) {
+			return r.allow, true
+		}
+	}
+	return false, false
+}
+
+// parseIPRules 解析 "allow|deny IP/CIDR|all" 格式的规则,忽略空行与#注释
+// 与ParseCIDRList不同,无效地址返回错误,避免拒绝规则被静默忽略
+func parseIPRules(lines []string) ([]ipRule, error) {
+	rules := make([]ipRule, 0, len(lines))
+	for _, line := range lines {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || fields[0] != "allow" && fields[0] != "deny" {
+			return nil, fmt.Errorf("invalid ip rule:%s", strings.TrimSpace(line))
+		}
+		r := ipRule{allow: fields[0] == "allow"}
+		if fields[1] != "all" {
+			n := ParseCIDRList(fields[1:])
+			if len(n) == 0 {
+				return nil, fmt.Errorf("invalid ip rule:%s", strings.TrimSpace(line))
+			}
+			r.net = n[0]
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// realIPResolver 来源为可信代理时,从右向左跳过可信代理地址,取请求头中第一个不可信的地址作为客户端IP
+// PROXY协议已在监听中处理,此时RemoteIP即为协议头中的客户端地址
+type realIPResolver struct {
+	header  string
+	trusted []*net.IPNet
+}
+
+func newRealIPResolver(args map[string]string) (*realIPResolver, error) {
+	trusted := argList(args, "trusted_proxies")
+	r := &realIPResolver{
+		header:  strings.TrimSpace(args["real_ip_header"]),
+		trusted: ParseCIDRList(trusted),
+	}
+	if len(r.trusted) != len(trusted) {
+		return nil, fmt.Errorf("invalid trusted_proxies:%s", args["trusted_proxies"])
+	}
+	if len(r.header) == 0 {
+		r.header = "X-Forwarded-For"
+	}
+	return r, nil
+}
+
+// resolve 解析客户端IP并保存到ctx,同一请求中多次解析时结果以最后一次为准
+func (r *realIPResolver) resolve(ctx *fasthttp.RequestCtx) net.IP {
+	ip := ctx.RemoteIP()
+	if len(r.trusted) > 0 && r.isTrusted(ip) {
+		// 代理可能追加新的请求头而不是合并到已有的头中,按出现顺序合并全部值
+		var values []byte
+		ctx.Request.Header.VisitAll(func(k, v []byte) {
+			if bytes.EqualFold(k, []byte(r.header)) {
+				if len(values) > 0 {
+					values = append(values, ',')
+				}
+				values = append(values, v...)
+			}
+		})
+		list := bytes.Split(values, []byte{','})
+		for i := len(list) - 1; i >= 0; i-- {
+			v := net.ParseIP(string(bytes.TrimSpace(list[i])))
+			if v == nil {
+				break
+			}
+			ip = v
+			if !r.isTrusted(v) {
+				break
+			}
+		}
+	}
+	ctx.SetUserValue(clientIPKey, ip)
+	return ip
+}
+
+func (r *realIPResolver) isTrusted(ip net.IP) bool {
+	for _, n := range r.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP 客户端IP,未经可信代理解析时为连接的来源地址
+func ClientIP(ctx *fasthttp.RequestCtx) net.IP {
+	if ip, ok := ctx.UserValue(clientIPKey).(net.IP); ok {
+		return ip
+	}
+	return ctx.RemoteIP()
+}
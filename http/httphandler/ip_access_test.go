@@ -0,0 +1,95 @@
+package httphandler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestIPAccessInterceptor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "blocklist")
+	ioutil.WriteFile(file, []byte("# blocked\ndeny 203.0.113.0/24\ndeny 2001:db8:bad::/48\n"), 0644)
+
+	hi, err := newIPAccessInterceptor(map[string]string{
+		"rules":           "deny 10.0.0.99, allow 10.0.0.0/8, allow ::1",
+		"files":           file,
+		"default":         "allow",
+		"trusted_proxies": "10.1.0.0/16",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	iai := hi.(*ipAccessInterceptor)
+
+	cases := []struct {
+		remote string
+		xff    string
+		allow  bool
+		client string
+	}{
+		{"10.0.0.1:1234", "", true, "10.0.0.1"},
+		{"10.0.0.99:1234", "", false, "10.0.0.99"},
+		{"[::1]:1234", "", true, "::1"},
+		{"203.0.113.7:1234", "", false, "203.0.113.7"},
+		{"[2001:db8:bad::1]:1234", "", false, "2001:db8:bad::1"},
+		{"192.0.2.1:1234", "", true, "192.0.2.1"},
+		// 可信代理转发时按X-Forwarded-For从右向左跳过可信地址
+		{"10.1.0.1:1234", "203.0.113.7, 10.1.0.2", false, "203.0.113.7"},
+		{"10.1.0.1:1234", "10.0.0.99, 192.0.2.1", true, "192.0.2.1"},
+		// 多个X-Forwarded-For头按顺序合并,客户端伪造的首个头不会被采用
+		{"10.1.0.1:1234", "203.0.113.7\n192.0.2.1, 10.1.0.2", true, "192.0.2.1"},
+		// 不可信来源的X-Forwarded-For被忽略
+		{"192.0.2.1:1234", "203.0.113.7", true, "192.0.2.1"},
+	}
+	for _, c := range cases {
+		ctx := newTestCtx(c.remote)
+		for _, v := range strings.Split(c.xff, "\n") {
+			if len(v) > 0 {
+				ctx.Request.Header.Add("X-Forwarded-For", v)
+			}
+		}
+		ok := iai.PreHandle(ctx)
+		if ok != c.allow || !ok && ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+			t.Errorf("%s %q: allow=%v status=%d, want %v", c.remote, c.xff, ok, ctx.Response.StatusCode(), c.allow)
+		}
+		if got := ClientIP(ctx).String(); got != c.client {
+			t.Errorf("%s %q: client ip %s, want %s", c.remote, c.xff, got, c.client)
+		}
+	}
+
+	// 文件变更后重新加载,无效内容保留原规则
+	ioutil.WriteFile(file, []byte("deny 192.0.2.0/24\n"), 0644)
+	os.Chtimes(file, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	iai.files[0].checked = time.Time{}
+	if iai.PreHandle(newTestCtx("192.0.2.1:1234")) {
+		t.Error("reloaded rule not applied")
+	}
+	ioutil.WriteFile(file, []byte("deny nonsense\n"), 0644)
+	os.Chtimes(file, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+	iai.files[0].checked = time.Time{}
+	if iai.PreHandle(newTestCtx("192.0.2.1:1234")) {
+		t.Error("invalid file replaced current rules")
+	}
+
+	for _, args := range []map[string]string{
+		{},
+		{"rules": "allow 10.0.0.0/33"},
+		{"rules": "permit all"},
+		{"rules": "allow all", "default": "maybe"},
+		{"rules": "allow all", "trusted_proxies": "proxy"},
+	} {
+		if _, err := newIPAccessInterceptor(args); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package httphandler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// jwksFetchTimeout 获取JWKS的超时时间
+	jwksFetchTimeout = 10 * time.Second
+
+	// jwksMinRefresh 遇到未知kid时重新获取JWKS的最小间隔
+	jwksMinRefresh = 30 * time.Second
+)
+
+// loadPublicKey 读取PEM格式的公钥或证书
+func loadPublicKey(file string) (*jwtKey, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("key_file [%s] is not PEM", file)
+	}
+	var pub interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		if pub, err = x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	default:
+		if pub, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	}
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return &jwtKey{kty: "RSA", key: key}, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("key_file [%s] only P-256 is supported", file)
+		}
+		return &jwtKey{kty: "EC", key: key}, nil
+	}
+	return nil, fmt.Errorf("key_file [%s] unsupported key type %T", file, pub)
+}
+
+// jwksSource JWKS文件或URL,文件变更时重新加载,URL按缓存时间重新获取
+// 获取在锁外进行,密钥原子替换,请求不会因获取阻塞在锁上
+type jwksSource struct {
+	file *reloadFile
+
+	url string
+	ttl time.Duration
+	// cached 当前密钥 []*jwtKey
+	cached atomic.Value
+	// fetched 上次获取的时间(UnixNano),失败时同样更新
+	fetched int64
+
+	lock sync.Mutex
+	// inflight 进行中的获取,完成时关闭,同一时间只有一个获取
+	inflight chan struct{}
+}
+
+func newJWKSSource(src string, ttl time.Duration) (*jwksSource, error) {
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		f, err := newReloadFile(src, func(b []byte) (interface{}, error) {
+			return parseJWKS(b)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &jwksSource{file: f}, nil
+	}
+	js := &jwksSource{url: src, ttl: ttl}
+	js.cached.Store([]*jwtKey(nil))
+	// 启动时获取失败不影响加载配置,请求时重试
+	if err := js.fetch(); err != nil {
+		log.Printf("fetch jwks [%s] error:%v\n", src, err)
+	}
+	return js, nil
+}
+
+// keys 当前密钥,URL缓存过期或kid未知时重新获取,失败时使用已缓存的密钥
+func (js *jwksSource) keys(kid string) []*jwtKey {
+	if js.file != nil {
+		return js.file.Get().([]*jwtKey)
+	}
+	keys := js.cached.Load().([]*jwtKey)
+	age := time.Since(time.Unix(0, atomic.LoadInt64(&js.fetched)))
+	unknown := (len(keys) == 0 || len(kid) > 0 && !hasKid(keys, kid)) && age >= jwksMinRefresh
+	if !unknown && age < js.ttl {
+		return keys
+	}
+	done := js.startFetch()
+	if !unknown {
+		// 缓存过期时后台获取,期间使用已缓存的密钥
+		return keys
+	}
+	// 未知kid可能是密钥轮换,等待获取完成,并发的请求共享同一次获取
+	<-done
+	return js.cached.Load().([]*jwtKey)
+}
+
+// startFetch 开始后台获取,已有进行中的获取时返回其完成通知
+func (js *jwksSource) startFetch() chan struct{} {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	if js.inflight != nil {
+		return js.inflight
+	}
+	done := make(chan struct{})
+	js.inflight = done
+	go func() {
+		if err := js.fetch(); err != nil {
+			log.Printf("fetch jwks [%s] error, keep cached:%v\n", js.url, err)
+		}
+		js.lock.Lock()
+		js.inflight = nil
+		js.lock.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+func (js *jwksSource) fetch() error {
+	// 失败时同样记录时间,避免后端不可用时每个请求都去获取
+	defer atomic.StoreInt64(&js.fetched, time.Now().UnixNano())
+	status, body, err := fasthttp.GetTimeout(nil, js.url, jwksFetchTimeout)
+	if err != nil {
+		return err
+	}
+	if status != fasthttp.StatusOK {
+		return fmt.Errorf("status %d", status)
+	}
+	keys, err := parseJWKS(body)
+	if err != nil {
+		return err
+	}
+	js.cached.Store(keys)
+	return nil
+}
+
+func hasKid(keys []*jwtKey, kid string) bool {
+	for _, k := range keys {
+		if k.kid == kid {
+			return true
+		}
+	}
+	return false
+}
+
+// parseJWKS 解析 {"keys":[...]},忽略不支持的密钥
+func parseJWKS(content []byte) ([]*jwtKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, err
+	}
+	keys := make([]*jwtKey, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+		key := &jwtKey{kid: k.Kid, kty: k.Kty}
+		switch k.Kty {
+		case "RSA":
+			n, e1 := decodeBigInt(k.N)
+			e, e2 := decodeBigInt(k.E)
+			if e1 != nil || e2 != nil || !e.IsInt64() {
+				log.Printf("jwks key [%s] invalid RSA key, ignored\n", k.Kid)
+				continue
+			}
+			key.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			x, e1 := decodeBigInt(k.X)
+			y, e2 := decodeBigInt(k.Y)
+			if k.Crv != "P-256" || e1 != nil || e2 != nil || !elliptic.P256().IsOnCurve(x, y) {
+				log.Printf("jwks key [%s] unsupported EC key, ignored\n", k.Kid)
+				continue
+			}
+			key.key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		case "oct":
+			b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.K, "="))
+			if err != nil || len(b) == 0 {
+				log.Printf("jwks key [%s] invalid oct key, ignored\n", k.Kid)
+				continue
+			}
+			key.key = b
+		default:
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,359 @@
+package httphandler
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+const (
+	// rateLimitKey 本次请求的限流结果,在PostHandle中写入响应头
+	rateLimitKey = "rate_limit"
+
+	// defaultRateLimitSize 区域默认的最大key数量
+	defaultRateLimitSize = 10000
+
+	// rateLimitMaxKeyLen 超过该长度的key使用摘要保存
+	rateLimitMaxKeyLen = 64
+
+	// rateLimitMaxDelay delay模式最长等待时间,等待期间占用处理请求的goroutine
+	rateLimitMaxDelay = time.Minute
+)
+
+// RateLimitZones 命名限流区域集合,每个服务实例持有一个,重新加载配置时保留同名区域的计数
+type RateLimitZones struct {
+	lock  sync.Mutex
+	zones map[string]*rateLimitZone
+}
+
+// NewRateLimitZones 创建限流区域集合
+func NewRateLimitZones() *RateLimitZones {
+	return &RateLimitZones{zones: make(map[string]*rateLimitZone, 8)}
+}
+
+// get 获取同名区域,参数变化时创建新区域
+func (rz *RateLimitZones) get(name, spec string, interval time.Duration, burst, size int) *rateLimitZone {
+	rz.lock.Lock()
+	defer rz.lock.Unlock()
+	if z, ok := rz.zones[name]; ok && z.spec == spec {
+		return z
+	}
+	z := newRateLimitZone(name, spec, interval, burst, size)
+	rz.zones[name] = z
+	return z
+}
+
+// Retain 只保留 dispatches 使用的区域,重新加载配置后调用,释放已删除或参数已变更的区域
+func (rz *RateLimitZones) Retain(dispatches []*Dispatch) {
+	used := make(map[*rateLimitZone]bool, len(rz.zones))
+	for _, d := range dispatches {
+		for _, list := range d.Interceptors {
+			for _, v := range list {
+				if rli, ok := v.(*rateLimitInterceptor); ok {
+					used[rli.zone] = true
+				}
+			}
+		}
+	}
+	rz.lock.Lock()
+	defer rz.lock.Unlock()
+	for name, z := range rz.zones {
+		if !used[z] {
+			delete(rz.zones, name)
+		}
+	}
+}
+
+// bindRateLimitZones 将命名区域的限流拦截器绑定到集合中的同名区域
+func bindRateLimitZones(m map[*config.LocationConfig][]HandlerInterceptor, zones *RateLimitZones) {
+	for _, list := range m {
+		for _, v := range list {
+			if rli, ok := v.(*rateLimitInterceptor); ok && len(rli.zone.name) > 0 {
+				z := rli.zone
+				rli.zone = zones.get(z.name, z.spec, z.interval, z.burst, z.size)
+			}
+		}
+	}
+}
+
+// rateLimitInterceptor 令牌桶限流,按key分别计数,超出时返回429或延迟处理
+//
+//	args:
+//	  zone:            区域名称,同一服务实例中同名且参数相同的拦截器共享计数,重新加载配置时保留计数;为空则独立计数
+//	  key:             计数key,逗号分隔组合: ip、path、header:名称、cookie:名称、claim:JWT声明,默认 ip
+//	  rate:            速率,如 10r/s、600r/m,纯数字为每秒
+//	  burst:           允许超出速率的请求数,默认 0
+//	  mode:            reject 超出时返回429(默认);delay 在burst内延迟至符合速率后处理,最长等待 burst/rate,不能超过1分钟
+//	  size:            最大key数量,超出时淘汰最久未使用的key,默认 10000;被淘汰的key即使仍在限流中也会重新计数
+//	  trusted_proxies: 可信代理,key为ip时从X-Forwarded-For解析客户端IP,未配置时使用ip_access解析的结果
+//	  real_ip_header:  客户端IP请求头,默认 X-Forwarded-For
+type rateLimitInterceptor struct {
+	zone   *rateLimitZone
+	keys   []rateLimitKeyFunc
+	delay  bool
+	realIP *realIPResolver
+}
+
+type rateLimitKeyFunc func(ctx *fasthttp.RequestCtx) string
+
+func newRateLimitInterceptor(args map[string]string) (HandlerInterceptor, error) {
+	rate, err := parseRate(args["rate"])
+	if err != nil {
+		return nil, err
+	}
+	burst, err := argInt(args, "burst", 0)
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	// 计数窗口为 (burst+1)*interval,不能超出time.Duration
+	if burst < 0 || int64(burst) >= math.MaxInt64/int64(interval) {
+		return nil, fmt.Errorf("invalid burst:%d", burst)
+	}
+	size, err := argInt(args, "size", defaultRateLimitSize)
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid size:%d", size)
+	}
+	rli := &rateLimitInterceptor{}
+	switch v := strings.TrimSpace(args["mode"]); v {
+	case "", "reject":
+	case "delay":
+		rli.delay = true
+		if time.Duration(burst)*interval > rateLimitMaxDelay {
+			return nil, fmt.Errorf("delay mode waits up to burst/rate, at most %v", rateLimitMaxDelay)
+		}
+	default:
+		return nil, fmt.Errorf("invalid mode:%s", v)
+	}
+	keys := argList(args, "key")
+	if len(keys) == 0 {
+		keys = []string{"ip"}
+	}
+	for _, k := range keys {
+		fn, err := rli.keyFunc(k)
+		if err != nil {
+			return nil, err
+		}
+		rli.keys = append(rli.keys, fn)
+	}
+	if len(args["trusted_proxies"]) > 0 {
+		if rli.realIP, err = newRealIPResolver(args); err != nil {
+			return nil, err
+		}
+	}
+	// 命名区域在创建dispatch时绑定到服务实例的区域集合
+	spec := fmt.Sprintf("%s|%v|%d|%d", strings.Join(keys, ","), rate, burst, size)
+	rli.zone = newRateLimitZone(strings.TrimSpace(args["zone"]), spec, interval, burst, size)
+	return rli, nil
+}
+
+func (rli *rateLimitInterceptor) keyFunc(k string) (rateLimitKeyFunc, error) {
+	kind, name := k, ""
+	if i := strings.IndexByte(k, ':'); i > 0 {
+		kind, name = k[:i], strings.TrimSpace(k[i+1:])
+	}
+	switch {
+	case kind == "ip":
+		return func(ctx *fasthttp.RequestCtx) string {
+			if rli.realIP != nil {
+				return rli.realIP.resolve(ctx).String()
+			}
+			return ClientIP(ctx).String()
+		}, nil
+	case kind == "path":
+		return func(ctx *fasthttp.RequestCtx) string { return string(ctx.Path()) }, nil
+	case kind == "header" && len(name) > 0:
+		return func(ctx *fasthttp.RequestCtx) string { return string(ctx.Request.Header.Peek(name)) }, nil
+	case kind == "cookie" && len(name) > 0:
+		return func(ctx *fasthttp.RequestCtx) string { return string(ctx.Request.Header.Cookie(name)) }, nil
+	case kind == "claim" && len(name) > 0:
+		return func(ctx *fasthttp.RequestCtx) string {
+			if v, ok := JWTClaims(ctx)[name]; ok {
+				return claimString(v)
+			}
+			return ""
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid key:%s", k)
+}
+
+func (rli *rateLimitInterceptor) PreHandle(ctx *fasthttp.RequestCtx) bool {
+	key, ok := rli.key(ctx)
+	if !ok {
+		// key为空的请求不限流,如未携带配置的请求头
+		return true
+	}
+	r := rli.zone.take(key, time.Now())
+	if !r.allowed {
+		log.Printf("[%s] rate limit [%s] exceeded for %s\n", RequestID(ctx), rli.zone.name, ctx.Path())
+		ErrorPage(ctx, fasthttp.StatusTooManyRequests)
+		ctx.Response.Header.Set("Retry-After", strconv.FormatInt(ceilSeconds(r.retry), 10))
+		r.writeHeaders(ctx)
+		return false
+	}
+	if rli.delay && r.wait > 0 {
+		time.Sleep(r.wait)
+	}
+	ctx.SetUserValue(rateLimitKey, r)
+	return true
+}
+
+func (rli *rateLimitInterceptor) PostHandle(ctx *fasthttp.RequestCtx) {
+	// 代理会替换整个响应,因此在处理完成后写入响应头
+	if r, ok := ctx.UserValue(rateLimitKey).(rateLimitResult); ok {
+		r.writeHeaders(ctx)
+	}
+}
+
+func (rli *rateLimitInterceptor) AfterCompletion(ctx *fasthttp.RequestCtx) {
+}
+
+// key 组合各部分得到计数key,全部为空时返回false
+func (rli *rateLimitInterceptor) key(ctx *fasthttp.RequestCtx) (string, bool) {
+	parts := make([]string, len(rli.keys))
+	empty := true
+	for i, fn := range rli.keys {
+		parts[i] = fn(ctx)
+		if len(parts[i]) > 0 {
+			empty = false
+		}
+	}
+	if empty {
+		return "", false
+	}
+	key := strings.Join(parts, "\x00")
+	if len(key) > rateLimitMaxKeyLen {
+		sum := sha256.Sum256([]byte(key))
+		key = string(sum[:])
+	}
+	return key, true
+}
+
+// rateLimitZone 限流区域,按GCRA算法计算每个key的理论到达时间,最久未使用的key在超出容量时淘汰
+type rateLimitZone struct {
+	name     string
+	spec     string
+	interval time.Duration
+	burst    int
+	size     int
+
+	lock  sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type rateLimitEntry struct {
+	key string
+	tat time.Time
+}
+
+// rateLimitResult 限流结果,wait 为delay模式下需要等待的时间,retry 为被拒绝时建议的重试间隔
+type rateLimitResult struct {
+	allowed   bool
+	limit     int
+	remaining int
+	reset     time.Duration
+	wait      time.Duration
+	retry     time.Duration
+}
+
+func newRateLimitZone(name, spec string, interval time.Duration, burst, size int) *rateLimitZone {
+	return &rateLimitZone{
+		name:     name,
+		spec:     spec,
+		interval: interval,
+		burst:    burst,
+		size:     size,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element, 64),
+	}
+}
+
+func (z *rateLimitZone) take(key string, now time.Time) rateLimitResult {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	// 理论到达时间已过的key与新key等价,从尾部清理
+	for e := z.ll.Back(); e != nil && !e.Value.(*rateLimitEntry).tat.After(now); e = z.ll.Back() {
+		z.ll.Remove(e)
+		delete(z.items, e.Value.(*rateLimitEntry).key)
+	}
+
+	var entry *rateLimitEntry
+	if e, ok := z.items[key]; ok {
+		z.ll.MoveToFront(e)
+		entry = e.Value.(*rateLimitEntry)
+	} else {
+		entry = &rateLimitEntry{key: key, tat: now}
+		z.items[key] = z.ll.PushFront(entry)
+		for z.ll.Len() > z.size {
+			e := z.ll.Back()
+			z.ll.Remove(e)
+			delete(z.items, e.Value.(*rateLimitEntry).key)
+		}
+	}
+
+	tat := entry.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	r := rateLimitResult{limit: z.burst + 1}
+	window := time.Duration(z.burst) * z.interval
+	if wait := tat.Sub(now); wait > window {
+		r.retry = wait - window
+		r.reset = wait
+		return r
+	}
+	r.allowed = true
+	r.wait = tat.Sub(now)
+	entry.tat = tat.Add(z.interval)
+	r.reset = entry.tat.Sub(now)
+	r.remaining = int((window + z.interval - r.reset) / z.interval)
+	return r
+}
+
+func (r rateLimitResult) writeHeaders(ctx *fasthttp.RequestCtx) {
+	ctx.Response.Header.Set("RateLimit-Limit", strconv.Itoa(r.limit))
+	ctx.Response.Header.Set("RateLimit-Remaining", strconv.Itoa(r.remaining))
+	ctx.Response.Header.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(r.reset), 10))
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+// parseRate 解析 10r/s、600r/m 格式的速率,纯数字为每秒,最大 1e9r/s,即请求间隔不小于1ns,请求间隔不能超出time.Duration
+func parseRate(v string) (float64, error) {
+	s := strings.TrimSpace(v)
+	unit := time.Second
+	switch {
+	case strings.HasSuffix(s, "r/s"):
+		s = s[:len(s)-3]
+	case strings.HasSuffix(s, "r/m"):
+		s, unit = s[:len(s)-3], time.Minute
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("invalid rate:%s", v)
+	}
+	rate := n / unit.Seconds()
+	if rate > float64(time.Second) {
+		return 0, fmt.Errorf("invalid rate:%s, at most 1e9r/s", v)
+	}
+	if float64(time.Second)/rate >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid rate:%s, interval overflows", v)
+	}
+	return rate, nil
+}
@@ -0,0 +1,117 @@
+package httphandler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+func TestRateLimitZone(t *testing.T) {
+	z := newRateLimitZone("", "ip", time.Second, 2, 2)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		r := z.take("a", now)
+		if !r.allowed || r.remaining != 2-i || r.wait != time.Duration(i)*time.Second {
+			t.Fatalf("request %d: %+v", i, r)
+		}
+	}
+	r := z.take("a", now)
+	if r.allowed || r.retry != time.Second || r.remaining != 0 {
+		t.Fatalf("burst exceeded: %+v", r)
+	}
+	if r = z.take("a", now.Add(time.Second)); !r.allowed {
+		t.Fatalf("not refilled: %+v", r)
+	}
+
+	// 超出容量时淘汰最久未使用的key
+	z.take("b", now)
+	z.take("c", now)
+	if _, ok := z.items["a"]; ok || len(z.items) != 2 {
+		t.Errorf("lru eviction: %d keys", len(z.items))
+	}
+	// 理论到达时间已过的key被清理
+	z.take("d", now.Add(time.Hour))
+	if len(z.items) != 1 {
+		t.Errorf("idle keys not evicted: %d keys", len(z.items))
+	}
+
+	zones := NewRateLimitZones()
+	if zones.get("shared", "ip|1", time.Second, 0, 10) != zones.get("shared", "ip|1", time.Second, 0, 10) {
+		t.Error("zone not shared")
+	}
+	if zones.get("shared", "ip|1", time.Second, 0, 10) == zones.get("shared", "ip|2", time.Second/2, 0, 10) {
+		t.Error("zone reused after rate changed")
+	}
+	// 不同服务实例的同名区域不共享计数
+	if zones.get("shared", "ip|1", time.Second, 0, 10) == NewRateLimitZones().get("shared", "ip|1", time.Second, 0, 10) {
+		t.Error("zone shared between instances")
+	}
+
+	// 重新加载后只保留仍在使用的区域
+	hi, err := newRateLimitInterceptor(map[string]string{"zone": "api", "rate": "1r/s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := map[*config.LocationConfig][]HandlerInterceptor{{}: {hi}}
+	bindRateLimitZones(m, zones)
+	zones.Retain([]*Dispatch{{Interceptors: m}})
+	if _, ok := zones.zones["shared"]; ok || zones.zones["api"] != hi.(*rateLimitInterceptor).zone {
+		t.Errorf("retained zones: %v", zones.zones)
+	}
+}
+
+func TestRateLimitInterceptor(t *testing.T) {
+	hi, err := newRateLimitInterceptor(map[string]string{"key": "header:X-Api-Key,path", "rate": "60r/m", "burst": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCtx := func(apiKey string) *fasthttp.RequestCtx {
+		ctx := newTestCtx("127.0.0.1:1234")
+		ctx.Request.SetRequestURI("http://localhost/api")
+		if len(apiKey) > 0 {
+			ctx.Request.Header.Set("X-Api-Key", apiKey)
+		}
+		return ctx
+	}
+	for i := 0; i < 2; i++ {
+		ctx := newCtx("k1")
+		if !hi.PreHandle(ctx) {
+			t.Fatalf("request %d rejected", i)
+		}
+		hi.PostHandle(ctx)
+		if string(ctx.Response.Header.Peek("RateLimit-Limit")) != "2" {
+			t.Errorf("request %d headers: %s", i, ctx.Response.Header.String())
+		}
+	}
+	ctx := newCtx("k1")
+	if hi.PreHandle(ctx) || ctx.Response.StatusCode() != fasthttp.StatusTooManyRequests ||
+		string(ctx.Response.Header.Peek("Retry-After")) != "1" ||
+		string(ctx.Response.Header.Peek("RateLimit-Remaining")) != "0" {
+		t.Errorf("limit not applied: %d %s", ctx.Response.StatusCode(), ctx.Response.Header.String())
+	}
+	if !hi.PreHandle(newCtx("k2")) {
+		t.Error("other key limited")
+	}
+
+	for _, args := range []map[string]string{
+		{"rate": "fast"},
+		{"rate": "1r/s", "key": "header"},
+		{"rate": "1r/s", "mode": "queue"},
+		{"rate": "1r/s", "burst": "-1"},
+		{"rate": "2e9r/s"},
+		// 请求间隔或计数窗口超出time.Duration
+		{"rate": "1e-10r/s"},
+		{"rate": "1r/m", "burst": "1000000000000"},
+		// delay模式最长等待超过1分钟
+		{"rate": "1r/s", "burst": "61", "mode": "delay"},
+	} {
+		if _, err := newRateLimitInterceptor(args); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+	if _, err := newRateLimitInterceptor(map[string]string{"rate": "1r/s", "burst": "60", "mode": "delay"}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,201 @@
+package httphandler
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+// HandlerFactory 按location配置创建处理器,args 为 handler.args
+type HandlerFactory func(lc *config.LocationConfig, args map[string]string) (Handler, error)
+
+// HandlerMappingFactory 按监听配置创建处理器映射,locations 为各host的location,args 为配置参数
+type HandlerMappingFactory func(sc *config.ServerConfig, locations map[string][]*config.LocationConfig, args map[string]string) (HandlerMapping, error)
+
+var (
+	handlerFactories        = make(map[string]HandlerFactory, 8)
+	handlerMappingFactories = make(map[string]HandlerMappingFactory, 8)
+	registryLock            sync.RWMutex
+)
+
+// RegisterHandler 注册处理器,location中以 handler: name 引用,同名时覆盖
+func RegisterHandler(name string, factory HandlerFactory) {
+	if len(name) == 0 || factory == nil {
+		panic("handler name and factory are required")
+	}
+	registryLock.Lock()
+	handlerFactories[name] = factory
+	registryLock.Unlock()
+}
+
+// RegisterHandlerMapping 注册处理器映射,server中以 handler_mappings: [name] 引用,同名时覆盖
+func RegisterHandlerMapping(name string, factory HandlerMappingFactory) {
+	if len(name) == 0 || factory == nil {
+		panic("handler mapping name and factory are required")
+	}
+	registryLock.Lock()
+	handlerMappingFactories[name] = factory
+	registryLock.Unlock()
+}
+
+// NewHandlerExecutionChain 创建执行链,lc 为命中的location,其拦截器由Dispatch填充
+func NewHandlerExecutionChain(handler Handler, lc *config.LocationConfig) *HandlerExecutionChain {
+	return &HandlerExecutionChain{
+		interceptorIndex: -1,
+		handler:          handler,
+		location:         lc,
+	}
+}
+
+// NewServerDispatch 按监听配置创建dispatch,upstreams 与 zones 为所属服务实例的后端服务组注册表与限流区域集合
+// 映射顺序:server配置的自定义映射、location指定的handler、反向代理、静态文件
+func NewServerDispatch(sc *config.ServerConfig, lc map[string][]*config.LocationConfig, upstreams *UpstreamRegistry, zones *RateLimitZones) (*Dispatch, error) {
+	if upstreams == nil || zones == nil {
+		return nil, fmt.Errorf("upstream registry and rate limit zones are required")
+	}
+	matcher, err := newLocationMatcher(lc)
+	if err != nil {
+		return nil, err
+	}
+	// location引用的后端服务组必须存在,避免请求时才发现
+	for host, lcs := range lc {
+		for _, v := range lcs {
+			if id := strings.TrimSpace(v.Upstream); len(id) > 0 && upstreams.Config(id) == nil {
+				return nil, fmt.Errorf("host %s location %s upstream [%s] not found", host, v.Pattern, id)
+			}
+			// 监听不校验客户端证书时请求永远无法通过
+			if v.ClientCert && !clientAuthEnabled(sc) {
+				return nil, fmt.Errorf("host %s location %s client_cert requires ssl listener with client_auth optional|required", host, v.Pattern)
+			}
+		}
+	}
+	mappings := make([]HandlerMapping, 0, len(sc.HandlerMappings)+3)
+	for _, hc := range sc.HandlerMappings {
+		name := strings.TrimSpace(hc.Name)
+		registryLock.RLock()
+		factory, ok := handlerMappingFactories[name]
+		registryLock.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown handler mapping:%s", name)
+		}
+		hm, err := factory(sc, lc, hc.Args)
+		if err != nil {
+			return nil, fmt.Errorf("handler mapping %s:%v", name, err)
+		}
+		mappings = append(mappings, hm)
+	}
+	named, err := NewNamedHandlerMapping(lc)
+	if err != nil {
+		return nil, err
+	}
+	if named != nil {
+		named.matcher = matcher
+		mappings = append(mappings, named)
+	}
+	interceptors, err := BuildInterceptors(sc)
+	if err != nil {
+		return nil, err
+	}
+	if err = addAuthRequestInterceptors(sc, interceptors, upstreams); err != nil {
+		return nil, err
+	}
+	bindRateLimitZones(interceptors, zones)
+	mappings = append(mappings,
+		&RoutingHandlerMapping{
+			LocConfig: lc,
+			Upstreams: upstreams,
+			matcher:   matcher,
+		},
+		&StaticFileHandlerMapping{
+			LocConfig: lc,
+			matcher:   matcher,
+		},
+	)
+	return &Dispatch{
+		handlerMappings: mappings,
+		Interceptors:    interceptors,
+	}, nil
+}
+
+// clientAuthEnabled 监听是否校验客户端证书
+func clientAuthEnabled(sc *config.ServerConfig) bool {
+	switch strings.ToLower(strings.TrimSpace(sc.TLS.ClientAuth)) {
+	case "", "none":
+		return false
+	}
+	return sc.SSL
+}
+
+// NamedHandlerMapping location通过 handler 指定注册处理器的映射
+type NamedHandlerMapping struct {
+	LocConfig  map[string][]*config.LocationConfig
+	matcher    *locationMatcher
+	handlerMap map[*config.LocationConfig]Handler
+}
+
+// NewNamedHandlerMapping 创建全部location指定的处理器,没有location指定handler时返回nil
+func NewNamedHandlerMapping(lc map[string][]*config.LocationConfig) (*NamedHandlerMapping, error) {
+	handlerMap := make(map[*config.LocationConfig]Handler, 8)
+	for host, lcs := range lc {
+		for _, v := range lcs {
+			name := strings.TrimSpace(v.Handler.Name)
+			if len(name) == 0 {
+				continue
+			}
+			registryLock.RLock()
+			factory, ok := handlerFactories[name]
+			registryLock.RUnlock()
+			if !ok {
+				return nil, fmt.Errorf("host %s location %s unknown handler:%s", host, v.Pattern, name)
+			}
+			h, err := factory(v, v.Handler.Args)
+			if err != nil {
+				return nil, fmt.Errorf("host %s location %s handler %s:%v", host, v.Pattern, name, err)
+			}
+			handlerMap[v] = &namedHandler{handler: h, lc: v}
+		}
+	}
+	if len(handlerMap) == 0 {
+		return nil, nil
+	}
+	return &NamedHandlerMapping{
+		LocConfig:  lc,
+		handlerMap: handlerMap,
+	}, nil
+}
+
+// GetHandler 命中的location指定了handler时返回其处理器
+func (nhm *NamedHandlerMapping) GetHandler(ctx *fasthttp.RequestCtx) *HandlerExecutionChain {
+	lcs, ok := nhm.LocConfig[hostWithoutPort(string(ctx.Request.Host()))]
+	if !ok || len(lcs) == 0 {
+		return nil
+	}
+	hitlc := nhm.matcher.match(lcs, string(ctx.Path()))
+	if hitlc == nil {
+		return nil
+	}
+	h, ok := nhm.handlerMap[hitlc]
+	if !ok {
+		return nil
+	}
+	return NewHandlerExecutionChain(h, hitlc)
+}
+
+// namedHandler 与内置处理器一致地处理请求/响应头
+type namedHandler struct {
+	handler Handler
+	lc      *config.LocationConfig
+}
+
+func (h *namedHandler) Handle(ctx *fasthttp.RequestCtx) {
+	for k, v := range h.lc.Request {
+		ctx.Request.Header.Set(k, ExpandVariables(ctx, v))
+	}
+	h.handler.Handle(ctx)
+	for k, v := range h.lc.Response {
+		ctx.Response.Header.Set(k, ExpandVariables(ctx, v))
+	}
+}
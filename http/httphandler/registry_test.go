@@ -0,0 +1,99 @@
+package httphandler
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+type bodyHandler struct {
+	body string
+}
+
+func (h *bodyHandler) Handle(ctx *fasthttp.RequestCtx) {
+	ctx.SetBodyString(h.body)
+}
+
+// pathMapping 仅处理指定路径
+type pathMapping struct {
+	path    string
+	handler Handler
+}
+
+func (m *pathMapping) GetHandler(ctx *fasthttp.RequestCtx) *HandlerExecutionChain {
+	if string(ctx.Path()) != m.path {
+		return nil
+	}
+	return NewHandlerExecutionChain(m.handler, nil)
+}
+
+func TestRegisteredHandlers(t *testing.T) {
+	RegisterHandler("test-body", func(lc *config.LocationConfig, args map[string]string) (Handler, error) {
+		return &bodyHandler{body: args["body"]}, nil
+	})
+	RegisterHandlerMapping("test-path", func(sc *config.ServerConfig, locations map[string][]*config.LocationConfig, args map[string]string) (HandlerMapping, error) {
+		return &pathMapping{path: args["path"], handler: &bodyHandler{body: "mapped"}}, nil
+	})
+
+	c, err := config.ParseConfig([]byte(`
+http:
+  servers:
+    - listen: ":8080"
+      handler_mappings:
+        - name: test-path
+          args: {path: "/mapped"}
+      hosts:
+        - host: localhost
+          locations:
+            - pattern: "^/custom"
+              handler:
+                name: test-body
+                args: {body: "custom"}
+              response: {"X-Handler": "test-body"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &c.HTTP.Servers[0]
+	lc := map[string][]*config.LocationConfig{
+		"localhost": {&sc.Hosts[0].Locations[0]},
+	}
+	d, err := NewServerDispatch(sc, lc, NewUpstreamRegistry(nil), NewRateLimitZones())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"/custom/a": "custom",
+		"/mapped":   "mapped",
+	}
+	for path, want := range cases {
+		ctx := newTestCtx("127.0.0.1:1234")
+		ctx.Request.SetRequestURI("http://localhost" + path)
+		d.DoDispatch(ctx)
+		if got := string(ctx.Response.Body()); got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+	ctx := newTestCtx("127.0.0.1:1234")
+	ctx.Request.SetRequestURI("http://localhost/custom")
+	d.DoDispatch(ctx)
+	if string(ctx.Response.Header.Peek("X-Handler")) != "test-body" {
+		t.Error("location response header not applied to custom handler")
+	}
+
+	sc.Hosts[0].Locations[0].Handler.Name = "missing"
+	if _, err = NewServerDispatch(sc, lc, NewUpstreamRegistry(nil), NewRateLimitZones()); err == nil {
+		t.Error("unknown handler accepted")
+	}
+	sc.Hosts[0].Locations[0].Handler.Name = "test-body"
+	if _, err = NewServerDispatch(sc, lc, nil, nil); err == nil {
+		t.Error("dispatch created without registry")
+	}
+	// 无效的正则在创建时返回错误,而不是在请求时panic
+	sc.Hosts[0].Locations[0].Pattern = "^/(custom"
+	if _, err = NewServerDispatch(sc, lc, NewUpstreamRegistry(nil), NewRateLimitZones()); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
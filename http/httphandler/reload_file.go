@@ -0,0 +1,76 @@
+package httphandler
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reloadFileInterval 检查文件变更的最小间隔
+const reloadFileInterval = time.Second
+
+// reloadFile 使用时按修改时间检查变更并重新解析的文件,解析失败时保留当前内容
+type reloadFile struct {
+	path  string
+	parse func([]byte) (interface{}, error)
+	value atomic.Value
+
+	lock    sync.Mutex
+	checked time.Time
+	modTime time.Time
+	size    int64
+}
+
+// newReloadFile 读取并解析文件,首次解析失败时返回错误
+func newReloadFile(path string, parse func([]byte) (interface{}, error)) (*reloadFile, error) {
+	f := &reloadFile{
+		path:  path,
+		parse: parse,
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.load(fi); err != nil {
+		return nil, err
+	}
+	f.checked = time.Now()
+	return f, nil
+}
+
+func (f *reloadFile) load(fi os.FileInfo) error {
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	v, err := f.parse(content)
+	if err != nil {
+		return err
+	}
+	f.value.Store(v)
+	f.modTime = fi.ModTime()
+	f.size = fi.Size()
+	return nil
+}
+
+// Get 当前内容,距上次检查超过 reloadFileInterval 时检查文件是否变更
+func (f *reloadFile) Get() interface{} {
+	f.lock.Lock()
+	if time.Since(f.checked) >= reloadFileInterval {
+		f.checked = time.Now()
+		if fi, err := os.Stat(f.path); err != nil {
+			log.Printf("stat [%s] error, keep current:%v\n", f.path, err)
+		} else if !fi.ModTime().Equal(f.modTime) || fi.Size() != f.size {
+			if err = f.load(fi); err != nil {
+				log.Printf("reload [%s] error, keep current:%v\n", f.path, err)
+			} else {
+				log.Printf("file [%s] reloaded\n", f.path)
+			}
+		}
+	}
+	f.lock.Unlock()
+	return f.value.Load()
+}
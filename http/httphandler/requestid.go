@@ -0,0 +1,136 @@
+package httphandler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+const (
+	// RequestIDKey 请求ID在RequestCtx.UserValue中的键
+	RequestIDKey = "request_id"
+
+	// 透传请求ID的最大长度
+	maxRequestIDLen = 128
+)
+
+// RequestIDHandler 请求ID生成与透传
+type RequestIDHandler struct {
+	header  string
+	trusted []*net.IPNet
+}
+
+// NewRequestIDHandler 创建请求ID处理器,未启用时返回nil
+func NewRequestIDHandler(rc *config.RequestIDConfig) *RequestIDHandler {
+	if rc == nil || !rc.Enable {
+		return nil
+	}
+	header := strings.TrimSpace(rc.Header)
+	if len(header) == 0 {
+		header = config.DefaultRequestIDHeader
+	}
+	return &RequestIDHandler{
+		header:  header,
+		trusted: ParseCIDRList(rc.Trusted),
+	}
+}
+
+// Header 请求ID头名称
+func (h *RequestIDHandler) Header() string {
+	return h.header
+}
+
+// Apply 确定当前请求的ID并写入请求头,请求头会随请求转发到后端服务
+func (h *RequestIDHandler) Apply(ctx *fasthttp.RequestCtx) string {
+	id := ""
+	incoming := ctx.Request.Header.Peek(h.header)
+	if len(incoming) > 0 && validRequestID(incoming) && h.isTrusted(ctx.RemoteIP()) {
+		id = string(incoming)
+	} else {
+		id = NewRequestID()
+	}
+	ctx.Request.Header.Set(h.header, id)
+	ctx.SetUserValue(RequestIDKey, id)
+	return id
+}
+
+// Echo 将请求ID写回响应头
+func (h *RequestIDHandler) Echo(ctx *fasthttp.RequestCtx) {
+	if id := RequestID(ctx); len(id) > 0 {
+		ctx.Response.Header.Set(h.header, id)
+	}
+}
+
+func (h *RequestIDHandler) isTrusted(ip net.IP) bool {
+	for _, n := range h.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestID 获取当前请求ID,未启用时返回空串
+func RequestID(ctx *fasthttp.RequestCtx) string {
+	if v, ok := ctx.UserValue(RequestIDKey).(string); ok {
+		return v
+	}
+	return ""
+}
+
+// NewRequestID 生成新的请求ID
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, e := rand.Read(b); e != nil {
+		log.Printf("generate request id error:%v\n", e)
+	}
+	return hex.EncodeToString(b)
+}
+
+// 仅接受可见ASCII字符,防止头注入与日志污染
+func validRequestID(id []byte) bool {
+	if len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseCIDRList 解析IP/CIDR列表,单个IP视为/32或/128
+func ParseCIDRList(list []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, v := range list {
+		s := strings.TrimSpace(v)
+		if len(s) == 0 {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				log.Printf("invalid ip:%s ignored\n", s)
+				continue
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, e := net.ParseCIDR(s)
+		if e != nil {
+			log.Printf("invalid cidr:%s ignored\n", s)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
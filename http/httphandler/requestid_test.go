@@ -0,0 +1,55 @@
+package httphandler
+
+import (
+	"net"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+func newTestCtx(remote string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	addr, _ := net.ResolveTCPAddr("tcp", remote)
+	ctx.Init(&fasthttp.Request{}, addr, nil)
+	return ctx
+}
+
+func TestRequestIDTrusted(t *testing.T) {
+	h := NewRequestIDHandler(&config.RequestIDConfig{
+		Enable:  true,
+		Trusted: []string{"10.0.0.0/8"},
+	})
+
+	ctx := newTestCtx("10.1.2.3:1234")
+	ctx.Request.Header.Set(config.DefaultRequestIDHeader, "abc-123")
+	if id := h.Apply(ctx); id != "abc-123" {
+		t.Errorf("trusted id not accepted, got %s", id)
+	}
+
+	ctx = newTestCtx("192.168.1.1:1234")
+	ctx.Request.Header.Set(config.DefaultRequestIDHeader, "abc-123")
+	id := h.Apply(ctx)
+	if id == "abc-123" || len(id) != 32 {
+		t.Errorf("untrusted id accepted, got %s", id)
+	}
+	if string(ctx.Request.Header.Peek(config.DefaultRequestIDHeader)) != id {
+		t.Error("request id not forwarded")
+	}
+	h.Echo(ctx)
+	if string(ctx.Response.Header.Peek(config.DefaultRequestIDHeader)) != id {
+		t.Error("request id not echoed")
+	}
+}
+
+func TestRequestIDInvalid(t *testing.T) {
+	h := NewRequestIDHandler(&config.RequestIDConfig{
+		Enable:  true,
+		Trusted: []string{"0.0.0.0/0"},
+	})
+	ctx := newTestCtx("10.1.2.3:1234")
+	ctx.Request.Header.Set(config.DefaultRequestIDHeader, "bad id")
+	if id := h.Apply(ctx); id == "bad id" {
+		t.Error("invalid id accepted")
+	}
+}
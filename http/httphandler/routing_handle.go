@@ -4,25 +4,22 @@ import (
 	"fmt"
 	"log"
 	"regexp"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/valyala/fasthttp"
 	"github.com/ztgoto/webrouting/config"
 	"github.com/ztgoto/webrouting/http/client"
-	"github.com/ztgoto/webrouting/utils"
-)
-
-var (
-	// RegexpCache 正则匹配缓存对象
-	RegexpCache = utils.NewConcurrentMap(32)
-	clientsMap  = make(map[string]*fasthttp.LBClient, 32)
 )
 
 // RoutingHandlerMapping 反向代理请求映射
 type RoutingHandlerMapping struct {
-	LocConfig  map[string][]*config.LocationConfig
+	LocConfig map[string][]*config.LocationConfig
+	// Upstreams 后端服务组注册表
+	Upstreams  *UpstreamRegistry
+	matcher    *locationMatcher
+	lock       sync.Mutex
 	handlerMap map[*config.LocationConfig]*RoutingHandler
 }
 
@@ -34,19 +31,22 @@ func (rhm *RoutingHandlerMapping) GetHandler(ctx *fasthttp.RequestCtx) *HandlerE
 		return nil
 	}
 
-	host := strings.Split(httphost, ":")[0]
+	host := hostWithoutPort(httphost)
 
 	lcs, ok := rhm.LocConfig[host]
 	if !ok || lcs == nil || len(lcs) <= 0 {
 		return nil
 	}
 
-	hitlc := matchLocationConfig(lcs, path)
+	hitlc := rhm.matcher.match(lcs, path)
 
 	if hitlc == nil {
 		return nil
 	}
 
+	rhm.lock.Lock()
+	defer rhm.lock.Unlock()
+
 	if rhm.handlerMap == nil {
 		rhm.handlerMap = make(map[*config.LocationConfig]*RoutingHandler, 32)
 	}
@@ -60,12 +60,20 @@ func (rhm *RoutingHandlerMapping) GetHandler(ctx *fasthttp.RequestCtx) *HandlerE
 			return nil
 		}
 
-		uc := findUpstreamConfig(proxy)
+		registry := rhm.Upstreams
+		uc := registry.Config(proxy)
 		if uc == nil {
-			panic(fmt.Sprintf("Upstream id[%s] not found", proxy))
+			log.Printf("[%s] upstream [%s] not found\n", RequestID(ctx), proxy)
+			return NewHandlerExecutionChain(badGatewayHandler, hitlc)
+		}
+		upstream, err := registry.Get(uc)
+		if err != nil {
+			// 不缓存,下次请求重试创建
+			log.Printf("[%s] %v\n", RequestID(ctx), err)
+			return NewHandlerExecutionChain(badGatewayHandler, hitlc)
 		}
 
-		rh = NewRoutingHandler(hitlc, uc)
+		rh = newRoutingHandler(hitlc, uc, upstream)
 		if rh == nil {
 			return nil
 		}
@@ -75,99 +83,56 @@ func (rhm *RoutingHandlerMapping) GetHandler(ctx *fasthttp.RequestCtx) *HandlerE
 	return &HandlerExecutionChain{
 		interceptorIndex: -1,
 		handler:          rh,
+		location:         hitlc,
 	}
 }
 
-func matchLocationConfig(lcs []*config.LocationConfig, path string) *config.LocationConfig {
-	var pattern string
-	var reg *regexp.Regexp
-	var hitlc *config.LocationConfig
-	for _, lc := range lcs {
-		pattern = strings.TrimSpace(lc.Pattern)
-		rt := RegexpCache.Get(pattern)
-		if rt == nil {
-			reg = regexp.MustCompile(pattern)
-			RegexpCache.Put(pattern, reg)
-		} else {
-			reg = rt.(*regexp.Regexp)
-		}
-		if reg.MatchString(path) {
-			hitlc = lc
-			break
-		}
-	}
-	return hitlc
+// locationMatcher 按路径匹配location,正则在创建dispatch时预编译,创建后只读
+type locationMatcher struct {
+	patterns map[string]*regexp.Regexp
 }
 
-func findUpstreamConfig(ucID string) *config.UpstreamConfig {
-	if config.GlobalConfig.Upstreams != nil && len(config.GlobalConfig.Upstreams) > 0 {
-		for _, v := range config.GlobalConfig.Upstreams {
-			if strings.TrimSpace(ucID) == strings.TrimSpace(v.ID) {
-				return &v
+// newLocationMatcher 编译全部location的正则,任一无效时返回错误
+func newLocationMatcher(lc map[string][]*config.LocationConfig) (*locationMatcher, error) {
+	m := &locationMatcher{patterns: make(map[string]*regexp.Regexp, 32)}
+	for host, lcs := range lc {
+		for _, v := range lcs {
+			pattern := strings.TrimSpace(v.Pattern)
+			if _, ok := m.patterns[pattern]; ok {
+				continue
+			}
+			reg, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("host %s location %s pattern:%v", host, v.Pattern, err)
 			}
+			m.patterns[pattern] = reg
 		}
 	}
-	return nil
+	return m, nil
 }
 
-// NewRoutingHandler 创建反向代理处理器
-func NewRoutingHandler(lc *config.LocationConfig, uc *config.UpstreamConfig) *RoutingHandler {
-	ucID := strings.TrimSpace(uc.ID)
-	if len(ucID) == 0 {
-		panic("UpstreamConfig ID is empty")
-	}
-
-	lbcClient, ok := clientsMap[ucID]
-	if !ok {
-		servers := uc.Servers
-		if servers == nil || len(servers) <= 0 {
-			panic("UpstreamConfig server list is empty")
+// match 返回第一个匹配path的location
+func (m *locationMatcher) match(lcs []*config.LocationConfig, path string) *config.LocationConfig {
+	for _, lc := range lcs {
+		reg, ok := m.patterns[strings.TrimSpace(lc.Pattern)]
+		if ok && reg.MatchString(path) {
+			return lc
 		}
+	}
+	return nil
+}
 
-		clients := make([]fasthttp.BalancingClient, len(servers))
+// statusHandler 返回固定状态码的错误页
+type statusHandler int
 
-		// 此处配置还需要细化
-		for i, v := range servers {
-			cfStr := strings.TrimSpace(v)
-			if len(cfStr) == 0 {
-				continue
-			}
-			cf := strings.Split(cfStr, ";")
-
-			addr := cf[0]
-			maxConns := config.DefaultClientMaxConnCount
-			if len(cf) > 1 && len(strings.TrimSpace(cf[1])) > 0 {
-				c, e := strconv.Atoi(strings.TrimSpace(cf[1]))
-				if e == nil && c > 0 {
-					maxConns = c
-				}
-			}
-			clients[i] = &client.BaseClient{
-				HostClient: fasthttp.HostClient{
-					Addr:         addr,
-					Dial:         fasthttp.Dial,
-					MaxConns:     maxConns,
-					ReadTimeout:  120 * time.Second,
-					WriteTimeout: 5 * time.Second,
-					// ReadBufferSize: *outMaxHeaderSize,
-				},
-			}
-			log.Printf("create client:%s,%d\n", addr, maxConns)
-		}
-		lbcClient = &fasthttp.LBClient{
-			Clients: clients,
-			// HealthCheck: func(req *fasthttp.Request, resp *fasthttp.Response, err error) bool {
-			// 	if err != nil {
-			// 		log.Println(err)
-			// 		return false
-			// 	}
-			// 	return true
-			// },
-		}
-		clientsMap[ucID] = lbcClient
+func (h statusHandler) Handle(ctx *fasthttp.RequestCtx) {
+	ErrorPage(ctx, int(h))
+}
 
-	}
+// badGatewayHandler 后端服务组不可用时的处理器
+var badGatewayHandler Handler = statusHandler(fasthttp.StatusBadGateway)
 
+func newRoutingHandler(lc *config.LocationConfig, uc *config.UpstreamConfig, upstream *client.Upstream) *RoutingHandler {
 	balance := uc.Balance
 
 	if len(strings.TrimSpace(balance)) == 0 {
@@ -181,7 +146,7 @@ func NewRoutingHandler(lc *config.LocationConfig, uc *config.UpstreamConfig) *Ro
 	}
 	// log.Println("create RoutingHandler")
 	return &RoutingHandler{
-		lbClient: lbcClient,
+		upstream: upstream,
 		Balance:  balance,
 		Timeout:  timeout,
 		lc:       lc,
@@ -190,7 +155,7 @@ func NewRoutingHandler(lc *config.LocationConfig, uc *config.UpstreamConfig) *Ro
 
 // RoutingHandler 反向代理处理器
 type RoutingHandler struct {
-	lbClient *fasthttp.LBClient
+	upstream *client.Upstream
 	Balance  string
 	Timeout  time.Duration
 	lc       *config.LocationConfig
@@ -198,10 +163,10 @@ type RoutingHandler struct {
 
 // Handle 反向代理处理器
 func (rh *RoutingHandler) Handle(ctx *fasthttp.RequestCtx) {
-	if rh.lbClient == nil {
+	if rh.upstream == nil {
 		return
 	}
-	client := rh.lbClient
+	client := rh.upstream
 
 	timeout := 30000 * time.Millisecond
 
@@ -213,21 +178,21 @@ func (rh *RoutingHandler) Handle(ctx *fasthttp.RequestCtx) {
 
 	if rh.lc != nil && rh.lc.Request != nil && len(rh.lc.Request) > 0 {
 		for k, v := range rh.lc.Request {
-			ctx.Request.Header.Set(k, v)
+			ctx.Request.Header.Set(k, ExpandVariables(ctx, v))
 		}
 	}
 
-	e := client.DoTimeout(&ctx.Request, &ctx.Response, timeout)
+	e := client.DoTimeoutFrom(&ctx.Request, &ctx.Response, ctx.RemoteAddr(), ctx.LocalAddr(), timeout)
 
 	if rh.lc != nil && rh.lc.Response != nil && len(rh.lc.Response) > 0 {
 		for k, v := range rh.lc.Response {
-			ctx.Response.Header.Set(k, v)
+			ctx.Response.Header.Set(k, ExpandVariables(ctx, v))
 		}
 	}
 
 	if e != nil {
-		ctx.Response.SetStatusCode(config.HTTPStatusBadGateway)
-		ctx.Response.SetBodyString("Bad Gateway")
+		log.Printf("[%s] %s %s upstream error:%v\n", RequestID(ctx), ctx.Method(), ctx.RequestURI(), e)
+		ErrorPage(ctx, config.HTTPStatusBadGateway)
 	}
 	// ctx.ResetBody()
 }
@@ -235,6 +200,8 @@ func (rh *RoutingHandler) Handle(ctx *fasthttp.RequestCtx) {
 // StaticFileHandlerMapping 静态文件服务请求映射
 type StaticFileHandlerMapping struct {
 	LocConfig  map[string][]*config.LocationConfig
+	matcher    *locationMatcher
+	lock       sync.Mutex
 	handlerMap map[*config.LocationConfig]*DefaultFileHandler
 }
 
@@ -246,19 +213,22 @@ func (sfhm *StaticFileHandlerMapping) GetHandler(ctx *fasthttp.RequestCtx) *Hand
 		return nil
 	}
 
-	host := strings.Split(httphost, ":")[0]
+	host := hostWithoutPort(httphost)
 
 	lcs, ok := sfhm.LocConfig[host]
 	if !ok || lcs == nil || len(lcs) <= 0 {
 		return nil
 	}
 
-	hitlc := matchLocationConfig(lcs, path)
+	hitlc := sfhm.matcher.match(lcs, path)
 
 	if hitlc == nil {
 		return nil
 	}
 
+	sfhm.lock.Lock()
+	defer sfhm.lock.Unlock()
+
 	if sfhm.handlerMap == nil {
 		sfhm.handlerMap = make(map[*config.LocationConfig]*DefaultFileHandler, 32)
 	}
@@ -283,6 +253,7 @@ func (sfhm *StaticFileHandlerMapping) GetHandler(ctx *fasthttp.RequestCtx) *Hand
 	return &HandlerExecutionChain{
 		interceptorIndex: -1,
 		handler:          h,
+		location:         hitlc,
 	}
 }
 
@@ -313,13 +284,36 @@ type DefaultFileHandler struct {
 func (h *DefaultFileHandler) Handle(ctx *fasthttp.RequestCtx) {
 	if h.lc != nil && h.lc.Request != nil && len(h.lc.Request) > 0 {
 		for k, v := range h.lc.Request {
-			ctx.Request.Header.Set(k, v)
+			ctx.Request.Header.Set(k, ExpandVariables(ctx, v))
 		}
 	}
 	h.handler(ctx)
 	if h.lc != nil && h.lc.Response != nil && len(h.lc.Response) > 0 {
 		for k, v := range h.lc.Response {
-			ctx.Response.Header.Set(k, v)
+			ctx.Response.Header.Set(k, ExpandVariables(ctx, v))
 		}
 	}
 }
+
+// checkClientCert location要求客户端证书时校验,未通过返回403;在拦截器之前执行
+func checkClientCert(ctx *fasthttp.RequestCtx, lc *config.LocationConfig) bool {
+	if lc == nil || !lc.ClientCert || ClientVerified(ctx) {
+		return true
+	}
+	ErrorPage(ctx, fasthttp.StatusForbidden)
+	return false
+}
+
+// hostWithoutPort 去掉Host中的端口,支持 [::1]:8080 形式的IPv6地址
+func hostWithoutPort(host string) string {
+	if strings.HasPrefix(host, "[") {
+		if i := strings.IndexByte(host, ']'); i > 0 {
+			return host[:i+1]
+		}
+		return host
+	}
+	if i := strings.IndexByte(host, ':'); i >= 0 {
+		return host[:i]
+	}
+	return host
+}
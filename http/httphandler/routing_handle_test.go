@@ -0,0 +1,120 @@
+package httphandler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+func TestClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverCert, serverKey := writeTestCert(t, dir, "server", "localhost")
+	clientCert, clientKey := writeTestCert(t, dir, "client")
+	root := filepath.Join(dir, "html")
+	os.Mkdir(root, 0755)
+	ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("ok"), 0644)
+
+	sc := &config.ServerConfig{
+		SSL: true,
+		TLS: config.TLSConfig{ClientCA: clientCert, ClientAuth: "optional"},
+		Hosts: []config.HostMappingConfig{{
+			Host: "localhost",
+			Locations: []config.LocationConfig{{
+				Pattern:    "^/",
+				Root:       root,
+				ClientCert: true,
+				// 每分钟1个请求,未通过证书校验的请求不应消耗配额
+				Interceptors: []config.InterceptorConfig{{Name: "rate_limit", Args: map[string]string{"rate": "1r/m"}}},
+			}},
+		}},
+	}
+	lc := map[string][]*config.LocationConfig{"localhost": {&sc.Hosts[0].Locations[0]}}
+	d, err := NewServerDispatch(sc, lc, NewUpstreamRegistry(nil), NewRateLimitZones())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pem, _ := ioutil.ReadFile(clientCert)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+	go (&fasthttp.Server{Handler: d.DoDispatch}).Serve(ln)
+	defer ln.Close()
+
+	get := func(certs []tls.Certificate) int {
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: certs},
+		}}
+		req, _ := http.NewRequest("GET", "https://"+ln.Addr().String()+"/a.txt", nil)
+		req.Host = "localhost"
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for i := 0; i < 2; i++ {
+		if code := get(nil); code != fasthttp.StatusForbidden {
+			t.Errorf("without cert: status %d", code)
+		}
+	}
+	cc, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get([]tls.Certificate{cc}); code != fasthttp.StatusOK {
+		t.Errorf("with cert: status %d", code)
+	}
+
+	// 监听不校验客户端证书时 client_cert 无法通过,创建时返回错误
+	for _, mode := range []string{"", "none"} {
+		sc.TLS.ClientAuth = mode
+		if _, err = NewServerDispatch(sc, lc, NewUpstreamRegistry(nil), NewRateLimitZones()); err == nil {
+			t.Errorf("client_auth %q: client_cert accepted", mode)
+		}
+	}
+	sc.TLS.ClientAuth = "required"
+	sc.SSL = false
+	if _, err = NewServerDispatch(sc, lc, NewUpstreamRegistry(nil), NewRateLimitZones()); err == nil {
+		t.Error("client_cert accepted on plain listener")
+	}
+}
+
+func TestHostWithoutPort(t *testing.T) {
+	cases := map[string]string{
+		"example.com":      "example.com",
+		"example.com:8080": "example.com",
+		"[::1]:8080":       "[::1]",
+		"[::1]":            "[::1]",
+	}
+	for host, want := range cases {
+		if got := hostWithoutPort(host); got != want {
+			t.Errorf("%s: %s, want %s", host, got, want)
+		}
+	}
+}
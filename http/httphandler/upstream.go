@@ -0,0 +1,381 @@
+package httphandler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ztgoto/webrouting/config"
+	"github.com/ztgoto/webrouting/http/client"
+)
+
+// UpstreamRegistry 后端服务组注册表,后端服务组在首次使用时按配置创建
+type UpstreamRegistry struct {
+	lock        sync.Mutex
+	configs     []config.UpstreamConfig
+	upstreams   map[string]*client.Upstream
+	discoveries map[string]io.Closer
+	// Resolver 节点域名解析使用的解析器,为nil时使用 net.DefaultResolver
+	Resolver Resolver
+
+	stateLock sync.Mutex
+	// state 持久化的节点状态,key为后端服务组ID
+	state map[string][]UpstreamServerState
+}
+
+// NewUpstreamRegistry 创建使用指定后端服务配置的注册表
+func NewUpstreamRegistry(configs []config.UpstreamConfig) *UpstreamRegistry {
+	if configs == nil {
+		configs = []config.UpstreamConfig{}
+	}
+	return &UpstreamRegistry{
+		configs:     configs,
+		upstreams:   make(map[string]*client.Upstream, 32),
+		discoveries: make(map[string]io.Closer, 8),
+		state:       make(map[string][]UpstreamServerState),
+	}
+}
+
+// Configs 后端服务配置
+func (r *UpstreamRegistry) Configs() []config.UpstreamConfig {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.configs
+}
+
+// Config 按ID查找后端服务配置
+func (r *UpstreamRegistry) Config(id string) *config.UpstreamConfig {
+	configs := r.Configs()
+	for i := range configs {
+		if strings.TrimSpace(id) == strings.TrimSpace(configs[i].ID) {
+			return &configs[i]
+		}
+	}
+	return nil
+}
+
+// Get 获取后端服务组,不存在时按配置创建
+// 配置应已通过 ValidateUpstreams 校验,此处的错误来自运行环境的变化,如节点文件被删除
+func (r *UpstreamRegistry) Get(uc *config.UpstreamConfig) (*client.Upstream, error) {
+	ucID := strings.TrimSpace(uc.ID)
+	if len(ucID) == 0 {
+		return nil, fmt.Errorf("upstream id is empty")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if u, ok := r.upstreams[ucID]; ok {
+		return u, nil
+	}
+
+	balance := strings.TrimSpace(uc.Balance)
+	if len(balance) == 0 {
+		balance = "random"
+	}
+	u := client.NewUpstream(ucID, balance)
+	if uc.TLS.Enable {
+		tlsConfig, err := newUpstreamTLSConfig(&uc.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("upstream[%s] tls:%v", ucID, err)
+		}
+		u.TLSConfig = tlsConfig
+	}
+	pp, err := client.ParseProxyProtocol(uc.ProxyProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("upstream[%s] %v", ucID, err)
+	}
+	u.ProxyProtocol = pp
+
+	if file := strings.TrimSpace(uc.File); len(file) > 0 {
+		fd, err := NewFileDiscovery(file, u)
+		if err != nil {
+			return nil, fmt.Errorf("upstream[%s] discovery file [%s]:%v", ucID, file, err)
+		}
+		r.discoveries[ucID] = fd
+		r.upstreams[ucID] = u
+		return u, nil
+	}
+
+	if uc.Resolve || len(strings.TrimSpace(uc.SRV)) > 0 {
+		r.discoveries[ucID] = NewDNSDiscovery(uc, u, r.Resolver)
+		r.upstreams[ucID] = u
+		return u, nil
+	}
+
+	if len(uc.Servers) == 0 {
+		return nil, fmt.Errorf("upstream[%s] server list is empty", ucID)
+	}
+	for _, v := range uc.Servers {
+		s := NewUpstreamServer(v)
+		if s == nil {
+			continue
+		}
+		if e := u.Add(s); e != nil {
+			log.Printf("upstream[%s] server[%s]:%v\n", ucID, s.Addr, e)
+		}
+	}
+	r.restore(u)
+	r.upstreams[ucID] = u
+	return u, nil
+}
+
+// ValidateUpstreams 校验后端服务配置,在启动与重新加载配置时调用,避免在请求时才发现配置错误
+func ValidateUpstreams(configs []config.UpstreamConfig) error {
+	ids := make(map[string]bool, len(configs))
+	for i := range configs {
+		uc := &configs[i]
+		id := strings.TrimSpace(uc.ID)
+		if len(id) == 0 {
+			return fmt.Errorf("upstream id is empty")
+		}
+		if ids[id] {
+			return fmt.Errorf("upstream[%s] duplicated", id)
+		}
+		ids[id] = true
+		if err := validateUpstream(uc); err != nil {
+			return fmt.Errorf("upstream[%s] %v", id, err)
+		}
+	}
+	return nil
+}
+
+func validateUpstream(uc *config.UpstreamConfig) error {
+	var tlsConfig *tls.Config
+	if uc.TLS.Enable {
+		cfg, err := newUpstreamTLSConfig(&uc.TLS)
+		if err != nil {
+			return fmt.Errorf("tls:%v", err)
+		}
+		tlsConfig = cfg
+	}
+	if _, err := client.ParseProxyProtocol(uc.ProxyProtocol); err != nil {
+		return err
+	}
+	if file := strings.TrimSpace(uc.File); len(file) > 0 {
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("discovery file:%v", err)
+		}
+		return nil
+	}
+	if len(uc.Servers) == 0 && len(strings.TrimSpace(uc.SRV)) == 0 {
+		return fmt.Errorf("server list is empty")
+	}
+	// 与创建节点的检查一致,无效的MaxConnections/Weight使用默认值,地址无效视为错误
+	u := client.NewUpstream(uc.ID, uc.Balance)
+	u.TLSConfig = tlsConfig
+	for _, v := range uc.Servers {
+		if len(strings.TrimSpace(v)) == 0 {
+			continue
+		}
+		addr, maxConns, _, err := parseServerSpec(v, false)
+		if err != nil {
+			return err
+		}
+		if err = u.Add(client.NewServer(addr, maxConns)); err != nil && err != client.ErrServerExists {
+			return fmt.Errorf("server[%s]:%v", addr, err)
+		}
+	}
+	return nil
+}
+
+// Find 获取已创建的后端服务组
+func (r *UpstreamRegistry) Find(id string) *client.Upstream {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.upstreams[strings.TrimSpace(id)]
+}
+
+// Upstreams 已创建的后端服务组列表,按ID排序
+func (r *UpstreamRegistry) Upstreams() []*client.Upstream {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	list := make([]*client.Upstream, 0, len(r.upstreams))
+	for _, v := range r.upstreams {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Reset 关闭节点发现并清空后端服务组,使用新的后端服务配置
+func (r *UpstreamRegistry) Reset(configs []config.UpstreamConfig) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for id, d := range r.discoveries {
+		d.Close()
+		delete(r.discoveries, id)
+	}
+	if configs == nil {
+		configs = []config.UpstreamConfig{}
+	}
+	r.configs = configs
+	r.upstreams = make(map[string]*client.Upstream, 32)
+}
+
+// Close 停止全部节点发现
+func (r *UpstreamRegistry) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for id, d := range r.discoveries {
+		d.Close()
+		delete(r.discoveries, id)
+	}
+}
+
+// ParseServerSpec 解析 host[:port][;MaxConnections][;Weight] 格式的节点配置,任一字段无效时返回错误
+func ParseServerSpec(spec string) (addr string, maxConns, weight int, err error) {
+	return parseServerSpec(spec, true)
+}
+
+// parseServerSpec strict为false时无效的MaxConnections/Weight与多余字段使用默认值,与配置文件的原有行为一致
+func parseServerSpec(spec string, strict bool) (addr string, maxConns, weight int, err error) {
+	cf := strings.Split(strings.TrimSpace(spec), ";")
+	addr = strings.TrimSpace(cf[0])
+	maxConns = config.DefaultClientMaxConnCount
+	weight = 1
+	if len(addr) == 0 {
+		err = fmt.Errorf("server spec [%s] addr is empty", spec)
+		return
+	}
+	if err = checkServerAddr(addr); err != nil {
+		err = fmt.Errorf("server spec [%s] %v", spec, err)
+		return
+	}
+	if len(cf) > 3 {
+		if strict {
+			err = fmt.Errorf("server spec [%s] too many fields", spec)
+			return
+		}
+		log.Printf("server spec [%s] too many fields, ignored\n", spec)
+	}
+	if len(cf) > 1 && len(strings.TrimSpace(cf[1])) > 0 {
+		c, e := strconv.Atoi(strings.TrimSpace(cf[1]))
+		if e != nil || c <= 0 {
+			if strict {
+				err = fmt.Errorf("server spec [%s] invalid MaxConnections", spec)
+				return
+			}
+			log.Printf("server spec [%s] invalid MaxConnections, use default %d\n", spec, maxConns)
+		} else {
+			maxConns = c
+		}
+	}
+	if len(cf) > 2 && len(strings.TrimSpace(cf[2])) > 0 {
+		w, e := strconv.Atoi(strings.TrimSpace(cf[2]))
+		if e != nil || w <= 0 {
+			if strict {
+				err = fmt.Errorf("server spec [%s] invalid Weight", spec)
+				return
+			}
+			log.Printf("server spec [%s] invalid Weight, use default %d\n", spec, weight)
+		} else {
+			weight = w
+		}
+	}
+	return
+}
+
+// checkServerAddr IPv6地址需使用 [addr]:port 格式,unix socket使用 unix:/path,端口需在1-65535之间
+func checkServerAddr(addr string) error {
+	if strings.HasPrefix(addr, "unix:") {
+		if len(addr) == len("unix:") {
+			return fmt.Errorf("unix socket path is empty")
+		}
+		return nil
+	}
+	if strings.HasPrefix(addr, "[") {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("ipv6 addr must be [host]:port")
+		}
+		return checkServerPort(port)
+	}
+	switch strings.Count(addr, ":") {
+	case 0:
+		return nil
+	case 1:
+		host, port, _ := net.SplitHostPort(addr)
+		if len(host) == 0 {
+			return fmt.Errorf("host is empty")
+		}
+		return checkServerPort(port)
+	}
+	return fmt.Errorf("ipv6 addr must be enclosed in brackets")
+}
+
+func checkServerPort(port string) error {
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("invalid port:%s", port)
+	}
+	return nil
+}
+
+// CheckServerAddr 校验管理接口添加的节点地址,需为 host:port、[ipv6]:port 或 unix:/path
+func CheckServerAddr(addr string) error {
+	if err := checkServerAddr(addr); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(addr, "unix:") && !strings.Contains(addr, ":") {
+		return fmt.Errorf("addr must be host:port")
+	}
+	return nil
+}
+
+// NewUpstreamServer 根据 host[:port][;MaxConnections][;Weight] 格式的配置创建后端服务节点
+// 用于配置文件中的 servers,无效的MaxConnections/Weight使用默认值
+func NewUpstreamServer(spec string) *client.Server {
+	if len(strings.TrimSpace(spec)) == 0 {
+		return nil
+	}
+	addr, maxConns, weight, err := parseServerSpec(spec, false)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	s := client.NewServer(addr, maxConns)
+	s.Weight = weight
+	log.Printf("create client:%s,%d,%d\n", addr, maxConns, weight)
+	return s
+}
+
+// newUpstreamTLSConfig 创建连接后端服务使用的TLS配置
+func newUpstreamTLSConfig(tc *config.UpstreamTLSConfig) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         strings.TrimSpace(tc.ServerName),
+		InsecureSkipVerify: tc.InsecureSkipVerify,
+	}
+	if tc.InsecureSkipVerify {
+		log.Println("upstream tls insecure_skip_verify enabled, do not use in production")
+	}
+	if len(tc.CA) > 0 {
+		pem, err := ioutil.ReadFile(tc.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca [%s] contains no certificate", tc.CA)
+		}
+		cfg.RootCAs = pool
+	}
+	if len(tc.Cert) > 0 || len(tc.Key) > 0 {
+		cert, err := tls.LoadX509KeyPair(tc.Cert, tc.Key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,180 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ztgoto/webrouting/config"
+	"github.com/ztgoto/webrouting/http/client"
+)
+
+// UpstreamServerState 持久化的后端服务节点
+type UpstreamServerState struct {
+	Addr     string `json:"addr"`
+	MaxConns int    `json:"max_conns"`
+	Weight   int    `json:"weight"`
+	// State 节点状态,配置中的节点被管理接口移除时为 removed
+	State string `json:"state"`
+	// Added 通过管理接口添加、不在配置中的节点
+	Added bool `json:"added,omitempty"`
+}
+
+// serverRemoved 配置中的节点被管理接口移除后的持久化状态
+const serverRemoved = "removed"
+
+// LoadState 读取节点状态文件,文件不存在时忽略
+func (r *UpstreamRegistry) LoadState(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := make(map[string][]UpstreamServerState)
+	if err = json.Unmarshal(content, &state); err != nil {
+		return err
+	}
+
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+	r.state = state
+	return nil
+}
+
+// SaveState 将已创建后端服务组的节点列表写入状态文件
+func (r *UpstreamRegistry) SaveState(path string) error {
+	content, err := json.MarshalIndent(r.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	// 先写临时文件再重命名,避免写入中断导致文件损坏
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Inherit 继承另一注册表的节点状态,重新加载配置创建新注册表时保留drain/disable状态
+func (r *UpstreamRegistry) Inherit(old *UpstreamRegistry) {
+	state := old.snapshot()
+	r.stateLock.Lock()
+	r.state = state
+	r.stateLock.Unlock()
+}
+
+// snapshot 使用已创建后端服务组的节点列表更新持久化状态,返回状态的副本
+func (r *UpstreamRegistry) snapshot() map[string][]UpstreamServerState {
+	// 先获取列表再加锁,与Get的加锁顺序保持一致
+	upstreams := r.Upstreams()
+	configs := make(map[string]map[string]bool, len(upstreams))
+	for _, u := range upstreams {
+		if uc := r.Config(u.ID); uc != nil {
+			configs[u.ID] = configServerAddrs(uc)
+		}
+	}
+
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+
+	for _, u := range upstreams {
+		inConfig := configs[u.ID]
+		servers := u.Servers()
+		list := make([]UpstreamServerState, 0, len(servers))
+		present := make(map[string]bool, len(servers))
+		for _, s := range servers {
+			present[s.Addr] = true
+			list = append(list, UpstreamServerState{
+				Addr:     s.Addr,
+				MaxConns: s.MaxConns,
+				Weight:   s.Weight,
+				State:    s.State().String(),
+				Added:    inConfig != nil && !inConfig[s.Addr],
+			})
+		}
+		for addr := range inConfig {
+			if !present[addr] {
+				list = append(list, UpstreamServerState{Addr: addr, State: serverRemoved})
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Addr < list[j].Addr })
+		r.state[u.ID] = list
+	}
+	state := make(map[string][]UpstreamServerState, len(r.state))
+	for id, list := range r.state {
+		state[id] = list
+	}
+	return state
+}
+
+// configServerAddrs 配置中的节点地址,节点来自文件或DNS时返回nil,其节点列表不持久化
+func configServerAddrs(uc *config.UpstreamConfig) map[string]bool {
+	if len(strings.TrimSpace(uc.File)) > 0 || uc.Resolve || len(strings.TrimSpace(uc.SRV)) > 0 {
+		return nil
+	}
+	addrs := make(map[string]bool, len(uc.Servers))
+	for _, v := range uc.Servers {
+		if addr, _, _, err := parseServerSpec(v, false); err == nil {
+			addrs[addr] = true
+		}
+	}
+	return addrs
+}
+
+// restore 恢复持久化的节点列表与drain/disable状态
+// 通过管理接口添加的节点重新添加,移除的配置节点重新移除;配置中新增的节点保留,从配置删除的节点不再恢复
+func (r *UpstreamRegistry) restore(u *client.Upstream) {
+	r.stateLock.Lock()
+	list := r.state[u.ID]
+	r.stateLock.Unlock()
+	restored := 0
+	for _, v := range list {
+		if v.State == serverRemoved {
+			if u.Remove(v.Addr) != nil {
+				restored++
+			}
+			continue
+		}
+		s := u.Get(v.Addr)
+		if s == nil && v.Added {
+			if err := checkServerAddr(v.Addr); err != nil || v.MaxConns <= 0 {
+				log.Printf("upstream[%s] state server [%s] invalid, ignored\n", u.ID, v.Addr)
+				continue
+			}
+			s = client.NewServer(v.Addr, v.MaxConns)
+			if v.Weight > 0 {
+				s.Weight = v.Weight
+			}
+			if err := u.Add(s); err != nil {
+				log.Printf("upstream[%s] state server [%s]:%v\n", u.ID, v.Addr, err)
+				continue
+			}
+			restored++
+		}
+		if s == nil {
+			continue
+		}
+		if state := client.ParseServerState(v.State); state != client.ServerUp {
+			s.SetState(state)
+			restored++
+		}
+	}
+	if restored > 0 {
+		log.Printf("upstream[%s] restored %d server states\n", u.ID, restored)
+	}
+}
@@ -0,0 +1,74 @@
+package httphandler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ztgoto/webrouting/config"
+	"github.com/ztgoto/webrouting/http/client"
+)
+
+func TestUpstreamStateRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	r := NewUpstreamRegistry([]config.UpstreamConfig{{ID: "app", Servers: []string{"127.0.0.1:8080", "127.0.0.1:8081"}}})
+	u, err := r.Get(r.Config("app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Get("127.0.0.1:8080").SetState(client.ServerDraining)
+	added := client.NewServer("127.0.0.1:9999", 10)
+	added.Weight = 3
+	u.Add(added)
+	u.Remove("127.0.0.1:8081")
+	if err = r.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	// 重启后:管理接口添加的节点恢复,移除的节点不再出现,配置中新增的节点保留
+	r = NewUpstreamRegistry([]config.UpstreamConfig{{ID: "app", Servers: []string{"127.0.0.1:8080;50", "127.0.0.1:8081", "127.0.0.1:8082"}}})
+	if err = r.LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+	if u, err = r.Get(r.Config("app")); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Servers()) != 3 || u.Get("127.0.0.1:8081") != nil {
+		t.Fatalf("restored servers: %d", len(u.Servers()))
+	}
+	s := u.Get("127.0.0.1:8080")
+	if s.State() != client.ServerDraining || s.MaxConns != 50 {
+		t.Errorf("restored server: state=%s max_conns=%d", s.State(), s.MaxConns)
+	}
+	if s = u.Get("127.0.0.1:9999"); s == nil || s.MaxConns != 10 || s.Weight != 3 {
+		t.Errorf("added server not restored: %+v", s)
+	}
+	if u.Get("127.0.0.1:8082").State() != client.ServerUp {
+		t.Error("new server not up")
+	}
+
+	// 保存后再次重启结果相同;从配置删除的节点不再恢复
+	if err = r.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	r = NewUpstreamRegistry([]config.UpstreamConfig{{ID: "app", Servers: []string{"127.0.0.1:8081", "127.0.0.1:8082"}}})
+	defer r.Close()
+	if err = r.LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+	if u, err = r.Get(r.Config("app")); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Servers()) != 2 || u.Get("127.0.0.1:8080") != nil || u.Get("127.0.0.1:8081") != nil || u.Get("127.0.0.1:9999") == nil {
+		t.Errorf("restored servers after config change: %d", len(u.Servers()))
+	}
+}
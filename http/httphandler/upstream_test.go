@@ -0,0 +1,147 @@
+package httphandler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+// writeTestCert 生成自签名证书,返回证书与私钥文件路径
+func writeTestCert(t *testing.T, dir, name string, dnsNames ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, name+".cert")
+	keyFile := filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+// startTLSBackend 启动HTTPS后端,证书只包含域名 backend.test,clientCA 不为空时要求客户端证书
+func startTLSBackend(t *testing.T, certFile, keyFile, clientCA string) *httptest.Server {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if len(clientCA) > 0 {
+		pem, _ := ioutil.ReadFile(clientCA)
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+		ts.TLS.ClientCAs = pool
+		ts.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	ts.StartTLS()
+	return ts
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverCert, serverKey := writeTestCert(t, dir, "backend", "backend.test")
+	clientCert, clientKey := writeTestCert(t, dir, "proxy")
+
+	ts := startTLSBackend(t, serverCert, serverKey, "")
+	defer ts.Close()
+	mts := startTLSBackend(t, serverCert, serverKey, clientCert)
+	defer mts.Close()
+	addr := strings.TrimPrefix(ts.URL, "https://")
+	maddr := strings.TrimPrefix(mts.URL, "https://")
+	port := addr[strings.LastIndexByte(addr, ':')+1:]
+
+	fr := &fakeResolver{hosts: map[string][]string{"backend.test": {"127.0.0.1"}}}
+
+	cases := []struct {
+		name  string
+		uc    config.UpstreamConfig
+		body  string
+		valid bool
+	}{
+		{"https", config.UpstreamConfig{Servers: []string{addr},
+			TLS: config.UpstreamTLSConfig{Enable: true, CA: serverCert, ServerName: "backend.test"}}, "ok", true},
+		// 证书不包含IP,未指定server_name时校验失败
+		{"verify ip", config.UpstreamConfig{Servers: []string{addr},
+			TLS: config.UpstreamTLSConfig{Enable: true, CA: serverCert}}, "", false},
+		{"untrusted ca", config.UpstreamConfig{Servers: []string{addr},
+			TLS: config.UpstreamTLSConfig{Enable: true, ServerName: "backend.test"}}, "", false},
+		{"skip verify", config.UpstreamConfig{Servers: []string{addr},
+			TLS: config.UpstreamTLSConfig{Enable: true, InsecureSkipVerify: true}}, "ok", true},
+		// 解析为IP的节点使用原主机名校验证书
+		{"resolve", config.UpstreamConfig{Servers: []string{"backend.test:" + port}, Resolve: true,
+			TLS: config.UpstreamTLSConfig{Enable: true, CA: serverCert}}, "ok", true},
+		{"mtls without cert", config.UpstreamConfig{Servers: []string{maddr},
+			TLS: config.UpstreamTLSConfig{Enable: true, CA: serverCert, ServerName: "backend.test"}}, "", false},
+		{"mtls", config.UpstreamConfig{Servers: []string{maddr},
+			TLS: config.UpstreamTLSConfig{Enable: true, CA: serverCert, ServerName: "backend.test", Cert: clientCert, Key: clientKey}}, "proxy", true},
+	}
+	for _, c := range cases {
+		c.uc.ID = "tls"
+		r := NewUpstreamRegistry([]config.UpstreamConfig{c.uc})
+		r.Resolver = fr
+		u, err := r.Get(r.Config("tls"))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if c.uc.Resolve {
+			waitServers(t, u, "127.0.0.1:"+port)
+		}
+		req := &fasthttp.Request{}
+		// 客户端请求为http,发送到HTTPS节点时使用节点的协议
+		req.SetRequestURI("http://backend.test/")
+		resp := &fasthttp.Response{}
+		err = u.DoTimeout(req, resp, 5*time.Second)
+		r.Close()
+		if !c.valid {
+			if err == nil {
+				t.Errorf("%s: request succeeded", c.name)
+			}
+			continue
+		}
+		if err != nil || string(resp.Body()) != c.body {
+			t.Errorf("%s: %v %q", c.name, err, resp.Body())
+		}
+	}
+}
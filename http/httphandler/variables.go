@@ -0,0 +1,124 @@
+package httphandler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// VariableFunc 变量取值函数
+type VariableFunc func(ctx *fasthttp.RequestCtx) string
+
+// variableLock 保护 variables,运行期间注册的变量与请求处理并发访问
+var variableLock sync.RWMutex
+
+var variables = map[string]VariableFunc{
+	"request_id":             RequestID,
+	"remote_addr":            func(ctx *fasthttp.RequestCtx) string { return ctx.RemoteIP().String() },
+	"ssl_client_verify":      clientVerify,
+	"ssl_client_s_dn":        clientSubject,
+	"ssl_client_san":         clientSAN,
+	"ssl_client_fingerprint": clientFingerprint,
+	"remote_user":            remoteUser,
+	"client_ip":              func(ctx *fasthttp.RequestCtx) string { return ClientIP(ctx).String() },
+	// 请求中的X-Forwarded-For追加客户端地址
+	"proxy_add_x_forwarded_for": proxyAddXForwardedFor,
+}
+
+// RegisterVariable 注册变量,可在location的request/response头中以 $name 引用
+func RegisterVariable(name string, fn VariableFunc) {
+	variableLock.Lock()
+	variables[name] = fn
+	variableLock.Unlock()
+}
+
+// ExpandVariables 替换值中的 $name 变量,未知变量原样保留
+func ExpandVariables(ctx *fasthttp.RequestCtx, value string) string {
+	if strings.IndexByte(value, '$') < 0 {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); {
+		if value[i] != '$' {
+			b.WriteByte(value[i])
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(value) && isVariableChar(value[j]) {
+			j++
+		}
+		variableLock.RLock()
+		fn, ok := variables[value[i+1:j]]
+		variableLock.RUnlock()
+		if ok {
+			b.WriteString(fn(ctx))
+		} else {
+			b.WriteString(value[i:j])
+		}
+		i = j
+	}
+	return b.String()
+}
+
+func isVariableChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// clientVerify 客户端证书校验结果 SUCCESS|NONE
+func clientVerify(ctx *fasthttp.RequestCtx) string {
+	if cs := ctx.TLSConnectionState(); cs != nil && len(cs.VerifiedChains) > 0 {
+		return "SUCCESS"
+	}
+	return "NONE"
+}
+
+// ClientVerified 是否携带了已校验的客户端证书
+func ClientVerified(ctx *fasthttp.RequestCtx) bool {
+	cs := ctx.TLSConnectionState()
+	return cs != nil && len(cs.VerifiedChains) > 0 && len(cs.PeerCertificates) > 0
+}
+
+func clientSubject(ctx *fasthttp.RequestCtx) string {
+	if !ClientVerified(ctx) {
+		return ""
+	}
+	return ctx.TLSConnectionState().PeerCertificates[0].Subject.String()
+}
+
+func clientSAN(ctx *fasthttp.RequestCtx) string {
+	if !ClientVerified(ctx) {
+		return ""
+	}
+	cert := ctx.TLSConnectionState().PeerCertificates[0]
+	names := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.URIs))
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, v := range cert.IPAddresses {
+		names = append(names, v.String())
+	}
+	for _, v := range cert.URIs {
+		names = append(names, v.String())
+	}
+	return strings.Join(names, ",")
+}
+
+// clientFingerprint 客户端证书SHA256指纹
+func clientFingerprint(ctx *fasthttp.RequestCtx) string {
+	if !ClientVerified(ctx) {
+		return ""
+	}
+	sum := sha256.Sum256(ctx.TLSConnectionState().PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func proxyAddXForwardedFor(ctx *fasthttp.RequestCtx) string {
+	ip := ctx.RemoteIP().String()
+	if xff := ctx.Request.Header.Peek("X-Forwarded-For"); len(xff) > 0 {
+		return string(xff) + ", " + ip
+	}
+	return ip
+}
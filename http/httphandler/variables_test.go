@@ -0,0 +1,32 @@
+package httphandler
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestExpandVariables(t *testing.T) {
+	RegisterVariable("test_var", func(ctx *fasthttp.RequestCtx) string { return "v" })
+	ctx := newTestCtx("10.1.2.3:1234")
+	if got := ExpandVariables(ctx, "$test_var-$remote_addr-$unknown"); got != "v-10.1.2.3-$unknown" {
+		t.Errorf("expanded %q", got)
+	}
+
+	// 注册与请求处理并发进行
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			RegisterVariable("test_var"+strconv.Itoa(i), func(ctx *fasthttp.RequestCtx) string { return "" })
+		}(i)
+		go func() {
+			defer wg.Done()
+			ExpandVariables(newTestCtx("10.1.2.3:1234"), "$test_var")
+		}()
+	}
+	wg.Wait()
+}
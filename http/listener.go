@@ -0,0 +1,136 @@
+package http
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseListen 解析监听地址,支持 tcp4:/tcp6:/unix: 前缀,默认tcp双栈
+// 如 ":80"、"[::1]:80"、"tcp4:0.0.0.0:80"、"tcp6:[::]:80"、"unix:/run/webrouting.sock"
+func parseListen(listen string) (network, addr string) {
+	listen = strings.TrimSpace(listen)
+	for _, n := range []string{"tcp4", "tcp6", "tcp", "unix"} {
+		if strings.HasPrefix(listen, n+":") {
+			return n, listen[len(n)+1:]
+		}
+	}
+	return "tcp", listen
+}
+
+// newListener 按监听地址创建监听,优先使用继承的监听
+func newListener(listen string) (net.Listener, error) {
+	if ln := takeInherited(listen); ln != nil {
+		log.Printf("listen [%s] inherited\n", listen)
+		return ln, nil
+	}
+	network, addr := parseListen(listen)
+	if network == "unix" {
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	}
+	var ln net.Listener
+	var err error
+	if network == "unix" {
+		ln, err = listenUnix(addr)
+	} else if isWorker() {
+		ln, err = listenReusePort(network, addr)
+	} else {
+		ln, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
+
+// removeStaleSocket 删除上次异常退出遗留的socket文件,socket仍在使用时返回错误
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("listen unix:%s file exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("listen unix:%s socket is in use", path)
+	}
+	log.Printf("remove stale socket [%s]\n", path)
+	return os.Remove(path)
+}
+
+// setSocketPerm 设置unix socket文件权限与属主,owner 格式 user[:group]
+// socket创建时仅属主可访问,mode为空时恢复按umask的默认权限;应先设置属主再放开权限
+func setSocketPerm(path, mode, owner string) error {
+	perm := defaultSocketMode()
+	if mode = strings.TrimSpace(mode); len(mode) > 0 {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid socket_mode:%s", mode)
+		}
+		perm = os.FileMode(m)
+	}
+	if owner = strings.TrimSpace(owner); len(owner) > 0 {
+		uid, gid := -1, -1
+		parts := strings.SplitN(owner, ":", 2)
+		if len(parts[0]) > 0 {
+			u, err := user.Lookup(parts[0])
+			if err != nil {
+				return err
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return err
+			}
+		}
+		if len(parts) > 1 && len(parts[1]) > 0 {
+			g, err := user.LookupGroup(parts[1])
+			if err != nil {
+				return err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return err
+			}
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(path, perm)
+}
+
+// hookListener 关闭时执行回调的监听,用于释放监听相关的后台任务
+type hookListener struct {
+	net.Listener
+	once    sync.Once
+	onClose func()
+}
+
+func (l *hookListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(l.onClose)
+	return err
+}
+
+// withCloseHook 为监听附加关闭回调,fn为nil时原样返回
+func withCloseHook(ln net.Listener, fn func()) net.Listener {
+	if fn == nil {
+		return ln
+	}
+	return &hookListener{
+		Listener: ln,
+		onClose:  fn,
+	}
+}
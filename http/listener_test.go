@@ -0,0 +1,216 @@
+package http
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+// unixGet 通过unix socket发送请求
+func unixGet(t *testing.T, path, uri string) string {
+	c := &fasthttp.Client{
+		Dial: func(addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}
+	status, body, err := c.GetTimeout(nil, "http://127.0.0.1"+uri, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != fasthttp.StatusOK {
+		t.Fatalf("%s status %d", uri, status)
+	}
+	return string(body)
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket permissions not supported")
+	}
+	dir, err := ioutil.TempDir("", "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("static"), 0644)
+	sock := filepath.Join(dir, "web.sock")
+
+	// 创建时仅属主可访问,权限在之后设置
+	ln, err := newListener("unix:" + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(sock); fi.Mode().Perm() != 0600 {
+		t.Errorf("socket created with %o", fi.Mode().Perm())
+	}
+	// 正在使用的socket不能被删除
+	if _, err = newListener("unix:" + sock); err == nil {
+		t.Error("socket in use replaced")
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	// 遗留的socket文件被删除后重新监听
+	backend := startTestServer(t, `
+http:
+  servers:
+    - listen: "unix:`+sock+`"
+      socket_mode: "0660"
+      hosts:
+        - host: 127.0.0.1
+          locations:
+            - pattern: "/"
+              root: "`+dir+`"
+              index: index.html
+`)
+	defer backend.Close()
+	if fi, _ := os.Stat(sock); fi.Mode().Perm() != 0660 {
+		t.Errorf("socket_mode not applied: %o", fi.Mode().Perm())
+	}
+	if got := unixGet(t, sock, "/"); got != "static" {
+		t.Errorf("unix listener body = %q", got)
+	}
+
+	// unix socket后端
+	front := startTestServer(t, `
+upstreams:
+  - id: backend
+    servers: ["unix:`+sock+`"]
+http:
+  servers:
+    - listen: "127.0.0.1:0"
+      hosts:
+        - host: 127.0.0.1
+          locations:
+            - pattern: "/"
+              upstream: backend
+              request: {"Host": "127.0.0.1"}
+`)
+	defer front.Close()
+	if got := getBody(t, "http://"+front.Addrs()["127.0.0.1:0"].String()+"/"); got != "static" {
+		t.Errorf("unix upstream body = %q", got)
+	}
+
+	// 设置权限失败时不登记监听,修正配置后可重新加载
+	reload := func(mode string) error {
+		c, err := config.ParseConfig([]byte(`
+http:
+  servers:
+    - listen: "127.0.0.1:0"
+    - listen: "unix:` + filepath.Join(dir, "reload.sock") + `"
+      socket_mode: "` + mode + `"
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return front.Reload(c)
+	}
+	listen := "unix:" + filepath.Join(dir, "reload.sock")
+	if err = reload("bad"); err == nil {
+		t.Error("invalid socket_mode accepted")
+	}
+	front.lock.Lock()
+	_, raw := front.raw[listen]
+	_, srv := front.servers[listen]
+	_, limit := front.limits[listen]
+	_, l := front.listeners[listen]
+	front.lock.Unlock()
+	if raw || srv || limit || l {
+		t.Errorf("failed listener registered: raw=%v server=%v limit=%v listener=%v", raw, srv, limit, l)
+	}
+	if err = reload("0660"); err != nil {
+		t.Error(err)
+	}
+
+	// 不是socket的文件不能被删除
+	file := filepath.Join(dir, "index.html")
+	if _, err = newListener("unix:" + file); err == nil {
+		t.Error("regular file replaced")
+	}
+	if _, err = os.Stat(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseListen(t *testing.T) {
+	cases := map[string][2]string{
+		":8080":             {"tcp", ":8080"},
+		"[::1]:8080":        {"tcp", "[::1]:8080"},
+		"tcp4:0.0.0.0:8080": {"tcp4", "0.0.0.0:8080"},
+		"tcp6:[::]:8080":    {"tcp6", "[::]:8080"},
+		" unix:/run/w.sock": {"unix", "/run/w.sock"},
+	}
+	for listen, want := range cases {
+		if network, addr := parseListen(listen); network != want[0] || addr != want[1] {
+			t.Errorf("%s: %s %s", listen, network, addr)
+		}
+	}
+}
+
+func TestIPv6Listener(t *testing.T) {
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("ipv6 not available")
+	} else {
+		ln.Close()
+	}
+	dir, err := ioutil.TempDir("", "ipv6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("static"), 0644)
+
+	backend := startTestServer(t, `
+http:
+  servers:
+    - listen: "tcp6:[::1]:0"
+      hosts:
+        - host: "[::1]"
+          locations: &static [{pattern: "/", root: "`+dir+`", index: index.html}]
+        - host: 127.0.0.1
+          locations: *static
+`)
+	defer backend.Close()
+	get := func(url string) string {
+		c := &fasthttp.Client{Dial: fasthttp.DialDualStack}
+		status, body, err := c.GetTimeout(nil, url, 5*time.Second)
+		if err != nil || status != fasthttp.StatusOK {
+			t.Fatalf("%s: %d %v", url, status, err)
+		}
+		return string(body)
+	}
+	addr := backend.Addrs()["tcp6:[::1]:0"].String()
+	if got := get("http://" + addr + "/"); got != "static" {
+		t.Errorf("ipv6 listener body = %q", got)
+	}
+
+	// 默认双栈监听同时接受IPv4与IPv6连接,IPv6后端以 [addr]:port 配置
+	front := startTestServer(t, `
+upstreams:
+  - id: backend
+    servers: ["`+addr+`"]
+http:
+  servers:
+    - listen: ":0"
+      hosts:
+        - host: 127.0.0.1
+          locations: &proxy [{pattern: "/", upstream: backend}]
+        - host: "[::1]"
+          locations: *proxy
+`)
+	defer front.Close()
+	port := front.Addrs()[":0"].(*net.TCPAddr).Port
+	for _, host := range []string{"127.0.0.1", "[::1]"} {
+		if got := get("http://" + host + ":" + strconv.Itoa(port) + "/"); got != "static" {
+			t.Errorf("dual-stack %s body = %q", host, got)
+		}
+	}
+}
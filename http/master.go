@@ -0,0 +1,334 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ztgoto/webrouting/config"
+)
+
+const (
+	// envWorker worker进程编号,由master设置
+	envWorker = "WEBROUTING_WORKER"
+
+	// worker异常退出后重新启动的等待时间
+	workerRestartDelay = time.Second
+)
+
+// workerProcess 一个worker进程
+type workerProcess struct {
+	cmd       *exec.Cmd
+	started   time.Time
+	adminAddr string
+	// retired 已被替换或正在停止,退出后不再重启
+	retired int32
+	exited  chan struct{}
+}
+
+// workerSlot worker编号及当前进程
+type workerSlot struct {
+	id       int
+	restarts int
+	proc     *workerProcess
+}
+
+// workerStatus 管理接口返回的worker状态
+type workerStatus struct {
+	ID        int       `json:"id"`
+	Pid       int       `json:"pid"`
+	Started   time.Time `json:"started"`
+	Restarts  int       `json:"restarts"`
+	AdminAddr string    `json:"admin_addr,omitempty"`
+}
+
+var (
+	workerSlots []*workerSlot
+
+	// masterListeners master创建并共享给worker的unix socket监听
+	masterListeners = make(map[string]net.Listener, 2)
+
+	masterLock sync.Mutex
+	stopping   int32
+	upgrading  int32
+
+	// masterTicketSeed 全部worker共享的票据密钥种子,worker替换后仍可恢复会话
+	masterTicketSeed string
+)
+
+// isWorker 当前进程是否为master启动的worker
+func isWorker() bool {
+	return len(os.Getenv(envWorker)) > 0
+}
+
+// IsMaster 是否以多进程模式的master运行
+func IsMaster() bool {
+	return config.GlobalConfig.Application.Workers > 0 && !isWorker()
+}
+
+// StartMaster 启动master进程:创建worker并在异常退出时重启,转发重新加载与停止信号
+// worker以SO_REUSEPORT各自绑定tcp监听,unix socket由master创建后共享
+// 未配置票据密钥文件时,worker使用master生成的种子派生相同的会话票据密钥,每24小时轮换
+func StartMaster() {
+	initMasterListeners()
+	seed, err := newTicketSeed()
+	if err != nil {
+		panic(err)
+	}
+	masterTicketSeed = seed
+	n := config.GlobalConfig.Application.Workers
+	masterLock.Lock()
+	for i := 0; i < n; i++ {
+		slot := &workerSlot{id: i}
+		p, err := spawnWorker(slot.id)
+		if err != nil {
+			masterLock.Unlock()
+			stopWorkers(syscall.SIGTERM)
+			panic(fmt.Sprintf("start worker %d:%v", i, err))
+		}
+		slot.proc = p
+		workerSlots = append(workerSlots, slot)
+		go watchWorker(slot, p)
+	}
+	masterLock.Unlock()
+	startMasterAdminServer()
+	log.Printf("master started, %d workers\n", n)
+
+	for {
+		select {
+		case <-config.ReloadSignal:
+			log.Println("---reload workers certificates---")
+			signalWorkers(syscall.SIGHUP)
+		case <-config.UpgradeSignal:
+			if atomic.CompareAndSwapInt32(&upgrading, 0, 1) {
+				go func() {
+					rollingRestart()
+					atomic.StoreInt32(&upgrading, 0)
+				}()
+			}
+		case <-config.QuitSignal:
+			log.Println("---graceful shutdown workers---")
+			stopWorkers(syscall.SIGQUIT)
+			closeMaster()
+			return
+		case <-config.CloseSignal:
+			log.Println("---close workers---")
+			stopWorkers(syscall.SIGTERM)
+			closeMaster()
+			return
+		}
+	}
+}
+
+// initMasterListeners 创建unix socket监听,tcp监听由各worker绑定
+func initMasterListeners() {
+	for i := range config.GlobalConfig.HTTP.Servers {
+		sc := &config.GlobalConfig.HTTP.Servers[i]
+		network, path := parseListen(sc.Listen)
+		if network != "unix" {
+			continue
+		}
+		ln, err := newListener(sc.Listen)
+		if err != nil {
+			panic(err)
+		}
+		if err = setSocketPerm(path, sc.SocketMode, sc.SocketOwner); err != nil {
+			panic(err)
+		}
+		masterListeners[sc.Listen] = ln
+	}
+}
+
+func closeMaster() {
+	if masterAdmin != nil {
+		masterAdmin.Close()
+	}
+	for _, ln := range masterListeners {
+		ln.Close()
+	}
+	log.Println("---master exit---")
+}
+
+// spawnWorker 启动worker并等待其监听全部启动
+func spawnWorker(id int) (*workerProcess, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	listens := make([]string, 0, len(masterListeners))
+	files := make([]*os.File, 0, len(masterListeners)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for listen, ln := range masterListeners {
+		f, e := ln.(filer).File()
+		if e != nil {
+			return nil, e
+		}
+		listens = append(listens, listen)
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	setWorkerAttr(cmd)
+	cmd.Env = append(os.Environ(),
+		envWorker+"="+strconv.Itoa(id),
+		envReadyFD+"="+strconv.Itoa(listenFDStart+len(listens)))
+	if len(listens) > 0 {
+		cmd.Env = append(cmd.Env, envListeners+"="+strings.Join(listens, ";"))
+	}
+	if len(masterTicketSeed) > 0 {
+		cmd.Env = append(cmd.Env, envTicketSeed+"="+masterTicketSeed)
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	w.Close()
+
+	ready := make(chan error, 1)
+	var line string
+	go func() {
+		var e error
+		line, e = bufio.NewReader(r).ReadString('\n')
+		ready <- e
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeReadyTimeout):
+		err = errors.New("timeout")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("worker %d not ready:%v", id, err)
+	}
+	log.Printf("worker %d pid %d started\n", id, cmd.Process.Pid)
+	return &workerProcess{
+		cmd:       cmd,
+		started:   time.Now(),
+		adminAddr: strings.TrimSpace(line),
+		exited:    make(chan struct{}),
+	}, nil
+}
+
+// watchWorker 等待worker退出,非主动停止时重新启动
+func watchWorker(slot *workerSlot, p *workerProcess) {
+	err := p.cmd.Wait()
+	close(p.exited)
+	if atomic.LoadInt32(&p.retired) == 1 || atomic.LoadInt32(&stopping) == 1 {
+		return
+	}
+	log.Printf("worker %d pid %d exited unexpectedly:%v, restarting\n", slot.id, p.cmd.Process.Pid, err)
+	for atomic.LoadInt32(&stopping) == 0 {
+		time.Sleep(workerRestartDelay)
+		np, e := spawnWorker(slot.id)
+		if e != nil {
+			log.Printf("restart worker %d error:%v\n", slot.id, e)
+			continue
+		}
+		masterLock.Lock()
+		if atomic.LoadInt32(&stopping) == 1 {
+			masterLock.Unlock()
+			np.cmd.Process.Signal(syscall.SIGTERM)
+			return
+		}
+		slot.proc = np
+		slot.restarts++
+		masterLock.Unlock()
+		go watchWorker(slot, np)
+		return
+	}
+}
+
+// rollingRestart 逐个启动新的worker并平滑停止旧worker,用于升级可执行文件
+func rollingRestart() {
+	masterLock.Lock()
+	slots := make([]*workerSlot, len(workerSlots))
+	copy(slots, workerSlots)
+	masterLock.Unlock()
+
+	for _, slot := range slots {
+		np, err := spawnWorker(slot.id)
+		if err != nil {
+			log.Printf("upgrade worker %d failed, stop upgrading:%v\n", slot.id, err)
+			return
+		}
+		masterLock.Lock()
+		old := slot.proc
+		slot.proc = np
+		masterLock.Unlock()
+		go watchWorker(slot, np)
+
+		atomic.StoreInt32(&old.retired, 1)
+		old.cmd.Process.Signal(syscall.SIGQUIT)
+		select {
+		case <-old.exited:
+		case <-time.After(drainTimeout(&config.GlobalConfig.Application) + time.Second):
+			old.cmd.Process.Kill()
+		}
+	}
+	log.Println("all workers upgraded")
+}
+
+func signalWorkers(sig os.Signal) {
+	masterLock.Lock()
+	defer masterLock.Unlock()
+	for _, slot := range workerSlots {
+		slot.proc.cmd.Process.Signal(sig)
+	}
+}
+
+// stopWorkers 向全部worker发送信号并等待退出
+func stopWorkers(sig os.Signal) {
+	atomic.StoreInt32(&stopping, 1)
+	masterLock.Lock()
+	procs := make([]*workerProcess, 0, len(workerSlots))
+	for _, slot := range workerSlots {
+		procs = append(procs, slot.proc)
+	}
+	masterLock.Unlock()
+	for _, p := range procs {
+		p.cmd.Process.Signal(sig)
+	}
+	for _, p := range procs {
+		<-p.exited
+	}
+}
+
+// workersStatus 全部worker状态
+func workersStatus() []workerStatus {
+	masterLock.Lock()
+	defer masterLock.Unlock()
+	list := make([]workerStatus, 0, len(workerSlots))
+	for _, slot := range workerSlots {
+		list = append(list, workerStatus{
+			ID:        slot.id,
+			Pid:       slot.proc.cmd.Process.Pid,
+			Started:   slot.proc.started,
+			Restarts:  slot.restarts,
+			AdminAddr: slot.proc.adminAddr,
+		})
+	}
+	return list
+}
@@ -0,0 +1,111 @@
+package http
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+const (
+	// master转发管理请求到worker的超时时间
+	workerAdminTimeout = 10 * time.Second
+)
+
+// workerAdminResult 单个worker的管理接口响应
+type workerAdminResult struct {
+	ID     int             `json:"id"`
+	Pid    int             `json:"pid"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+var (
+	workerAdminClient = &fasthttp.Client{}
+
+	// masterAdmin master管理接口的监听
+	masterAdmin net.Listener
+)
+
+// startMasterAdminServer master管理接口:
+//
+//	GET /api/workers  worker进程状态
+//	其他 /api/ 请求转发到全部worker并汇总响应 {"workers":[...]}
+func startMasterAdminServer() {
+	ac := config.GlobalConfig.Application.Admin
+	listen := strings.TrimSpace(ac.Listen)
+	if len(listen) == 0 {
+		return
+	}
+	if err := checkAdminListen(listen, ac.Token); err != nil {
+		panic(err)
+	}
+	ln, err := newListener(listen)
+	if err != nil {
+		panic(err)
+	}
+	masterAdmin = ln
+	go func() {
+		if e := fasthttp.Serve(ln, masterAdminHandler); e != nil {
+			log.Printf("admin server[%s] error:%v\n", listen, e)
+		}
+		log.Printf("admin server[%s] closed!", listen)
+	}()
+	log.Printf("master admin server start [%s]!\n", listen)
+}
+
+func masterAdminHandler(ctx *fasthttp.RequestCtx) {
+	if !adminAuthorized(ctx, config.GlobalConfig.Application.Admin.Token) {
+		ctx.Response.Header.Set("WWW-Authenticate", "Bearer")
+		writeJSONError(ctx, fasthttp.StatusUnauthorized, "unauthorized")
+		return
+	}
+	path := strings.Trim(string(ctx.Path()), "/")
+	if path == "api/workers" && ctx.IsGet() {
+		writeJSON(ctx, fasthttp.StatusOK, workersStatus())
+		return
+	}
+	if !strings.HasPrefix(path, "api/") {
+		writeJSONError(ctx, fasthttp.StatusNotFound, "not found")
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{"workers": forwardToWorkers(ctx)})
+}
+
+// forwardToWorkers 将管理请求并发转发到全部worker
+func forwardToWorkers(ctx *fasthttp.RequestCtx) []workerAdminResult {
+	workers := workersStatus()
+	results := make([]workerAdminResult, len(workers))
+	var wg sync.WaitGroup
+	for i, ws := range workers {
+		results[i] = workerAdminResult{ID: ws.ID, Pid: ws.Pid}
+		if len(ws.AdminAddr) == 0 {
+			results[i].Error = "worker admin not available"
+			continue
+		}
+		wg.Add(1)
+		go func(r *workerAdminResult, addr string) {
+			defer wg.Done()
+			req := fasthttp.AcquireRequest()
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseRequest(req)
+			defer fasthttp.ReleaseResponse(resp)
+			ctx.Request.CopyTo(req)
+			req.SetRequestURI("http://" + addr + string(ctx.RequestURI()))
+			if err := workerAdminClient.DoTimeout(req, resp, workerAdminTimeout); err != nil {
+				r.Error = err.Error()
+				return
+			}
+			r.Status = resp.StatusCode()
+			r.Body = append(json.RawMessage(nil), resp.Body()...)
+		}(&results[i], ws.AdminAddr)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,127 @@
+//go:build !windows
+// +build !windows
+
+package http
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+// TestMain 由spawnWorker重新执行的测试程序作为worker运行
+func TestMain(m *testing.M) {
+	if isWorker() {
+		runTestWorker()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runTestWorker 测试worker:管理接口返回编号与派生的票据密钥,收到停止信号后退出
+func runTestWorker() {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.Exit(1)
+	}
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+		key := sharedTicketKeys(sharedTicketSeed(), time.Now())[0]
+		fmt.Fprintf(ctx, `{"id":%q,"ticket":%q}`, os.Getenv(envWorker), hex.EncodeToString(key[:]))
+	})
+	notifyReady(ln.Addr().String())
+	select {
+	case <-config.CloseSignal:
+	case <-config.QuitSignal:
+	}
+}
+
+type testWorkerBody struct {
+	ID     string `json:"id"`
+	Ticket string `json:"ticket"`
+}
+
+func TestMasterWorkers(t *testing.T) {
+	seed, err := newTicketSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterTicketSeed = seed
+	token := config.GlobalConfig.Application.Admin.Token
+	config.GlobalConfig.Application.Admin.Token = "secret"
+	defer func() {
+		stopWorkers(syscall.SIGTERM)
+		masterLock.Lock()
+		workerSlots = nil
+		masterLock.Unlock()
+		atomic.StoreInt32(&stopping, 0)
+		masterTicketSeed = ""
+		config.GlobalConfig.Application.Admin.Token = token
+	}()
+
+	masterLock.Lock()
+	for i := 0; i < 2; i++ {
+		slot := &workerSlot{id: i}
+		p, err := spawnWorker(slot.id)
+		if err != nil {
+			masterLock.Unlock()
+			t.Fatal(err)
+		}
+		slot.proc = p
+		workerSlots = append(workerSlots, slot)
+		go watchWorker(slot, p)
+	}
+	masterLock.Unlock()
+
+	status := workersStatus()
+	if len(status) != 2 || len(status[0].AdminAddr) == 0 || status[0].Pid == status[1].Pid {
+		t.Fatalf("workers status: %+v", status)
+	}
+
+	// master管理接口需要token,转发请求并汇总各worker的响应
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/api/ticket")
+	masterAdminHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Errorf("unauthorized status %d", ctx.Response.StatusCode())
+	}
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/api/ticket")
+	ctx.Request.Header.Set("Authorization", "Bearer secret")
+	masterAdminHandler(ctx)
+	var result struct {
+		Workers []workerAdminResult `json:"workers"`
+	}
+	if err = json.Unmarshal(ctx.Response.Body(), &result); err != nil || len(result.Workers) != 2 {
+		t.Fatalf("forward result: %v %s", err, ctx.Response.Body())
+	}
+	bodies := make([]testWorkerBody, 2)
+	for i, r := range result.Workers {
+		if r.Status != fasthttp.StatusOK || json.Unmarshal(r.Body, &bodies[i]) != nil {
+			t.Fatalf("worker %d result: %+v", i, r)
+		}
+	}
+	// 全部worker的票据密钥相同,连接分配到任一worker都可以恢复会话
+	if bodies[0].ID == bodies[1].ID || len(bodies[0].Ticket) == 0 || bodies[0].Ticket != bodies[1].Ticket {
+		t.Errorf("worker bodies: %+v", bodies)
+	}
+
+	// 异常退出的worker被重新启动
+	old := status[0].Pid
+	syscall.Kill(old, syscall.SIGKILL)
+	for i := 0; i < 100; i++ {
+		if s := workersStatus()[0]; s.Restarts == 1 && s.Pid != old {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Errorf("worker not restarted: %+v", workersStatus())
+}
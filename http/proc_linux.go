@@ -0,0 +1,15 @@
+//go:build linux
+// +build linux
+
+package http
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setWorkerAttr worker使用独立进程组,终端信号只发送给master,由master转发
+// master异常退出时worker收到SIGTERM,避免遗留的worker继续占用监听端口
+func setWorkerAttr(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGTERM}
+}
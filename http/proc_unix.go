@@ -0,0 +1,14 @@
+//go:build !windows && !linux
+// +build !windows,!linux
+
+package http
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setWorkerAttr worker使用独立进程组,终端信号只发送给master,由master转发
+func setWorkerAttr(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
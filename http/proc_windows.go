@@ -0,0 +1,9 @@
+package http
+
+import (
+	"os/exec"
+)
+
+// setWorkerAttr windows不支持SO_REUSEPORT,多进程模式不可用
+func setWorkerAttr(cmd *exec.Cmd) {
+}
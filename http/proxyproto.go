@@ -0,0 +1,227 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ztgoto/webrouting/http/httphandler"
+)
+
+const (
+	// PROXY协议头读取超时
+	proxyHeaderTimeout = 5 * time.Second
+
+	// v1头最大长度
+	proxyV1MaxLen = 107
+)
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeader = errors.New("invalid proxy protocol header")
+)
+
+// proxyTrustedUnix proxy_protocol_trusted 中表示信任unix socket来源的关键字
+const proxyTrustedUnix = "unix"
+
+// proxyListener 解析PROXY协议头的监听,仅信任来源地址在trusted中的连接,unix 为true时信任unix socket来源
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	unix    bool
+}
+
+func newProxyListener(ln net.Listener, trusted []*net.IPNet, unix bool) net.Listener {
+	return &proxyListener{
+		Listener: ln,
+		trusted:  trusted,
+		unix:     unix,
+	}
+}
+
+// parseProxyTrusted 解析可信来源,unix 关键字之外为IP或CIDR
+func parseProxyTrusted(list []string) (trusted []*net.IPNet, unix bool) {
+	cidrs := make([]string, 0, len(list))
+	for _, v := range list {
+		if strings.EqualFold(strings.TrimSpace(v), proxyTrustedUnix) {
+			unix = true
+			continue
+		}
+		cidrs = append(cidrs, v)
+	}
+	return httphandler.ParseCIDRList(cidrs), unix
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	// 延迟到首次读取时解析,避免慢连接阻塞Accept
+	return &proxyConn{
+		Conn: c,
+		br:   bufio.NewReader(c),
+	}, nil
+}
+
+// isTrusted 未配置的来源均不信任,unix socket来源需明确配置 unix
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return l.unix
+	}
+	for _, n := range l.trusted {
+		if n.Contains(ta.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn 使用PROXY协议头中的地址作为连接地址
+type proxyConn struct {
+	net.Conn
+	br     *bufio.Reader
+	once   sync.Once
+	err    error
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.local, c.err = readProxyHeader(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Printf("proxy protocol from %s:%v\n", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader 读取v1或v2协议头,UNKNOWN/LOCAL时返回nil地址
+func readProxyHeader(br *bufio.Reader) (remote, local net.Addr, err error) {
+	b, err := br.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(b, proxyV1Prefix) {
+		return readProxyV1(br)
+	}
+	b, err = br.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(b, proxyV2Sig) {
+		return readProxyV2(br)
+	}
+	return nil, nil, errProxyHeader
+}
+
+// readProxyV1 PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyV1(br *bufio.Reader) (remote, local net.Addr, err error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	for len(line) < proxyV1MaxLen {
+		c, e := br.ReadByte()
+		if e != nil {
+			return nil, nil, e
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errProxyHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errProxyHeader
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, e1 := strconv.Atoi(fields[4])
+	dstPort, e2 := strconv.Atoi(fields[5])
+	if srcIP == nil || dstIP == nil || e1 != nil || e2 != nil {
+		return nil, nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
+
+func readProxyV2(br *bufio.Reader) (remote, local net.Addr, err error) {
+	head := make([]byte, 16)
+	if _, err = io.ReadFull(br, head); err != nil {
+		return nil, nil, err
+	}
+	verCmd, fam := head[12], head[13]
+	size := int(binary.BigEndian.Uint16(head[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, nil, errProxyHeader
+	}
+	body := make([]byte, size)
+	if _, err = io.ReadFull(br, body); err != nil {
+		return nil, nil, err
+	}
+	// LOCAL命令为负载均衡器的健康检查等,使用真实连接地址
+	if verCmd&0x0f == 0 {
+		return nil, nil, nil
+	}
+	if verCmd&0x0f != 1 {
+		return nil, nil, errProxyHeader
+	}
+	switch fam >> 4 {
+	case 1: // AF_INET
+		if size < 12 {
+			return nil, nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))},
+			&net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}, nil
+	case 2: // AF_INET6
+		if size < 36 {
+			return nil, nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))},
+			&net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}, nil
+	}
+	// AF_UNSPEC/AF_UNIX 不提供IP地址
+	return nil, nil, nil
+}
@@ -0,0 +1,134 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ztgoto/webrouting/config"
+	"github.com/ztgoto/webrouting/http/client"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+
+	cases := []struct {
+		version  string
+		src, dst net.Addr
+	}{
+		{client.ProxyProtocolV1, src, dst},
+		{client.ProxyProtocolV2, src, dst},
+		{client.ProxyProtocolV1, src6, dst6},
+		{client.ProxyProtocolV2, src6, dst6},
+	}
+	for _, c := range cases {
+		var b bytes.Buffer
+		if err := client.WriteProxyHeader(&b, c.version, c.src, c.dst); err != nil {
+			t.Fatal(err)
+		}
+		b.WriteString("GET / HTTP/1.1\r\n")
+		br := bufio.NewReader(&b)
+		remote, local, err := readProxyHeader(br)
+		if err != nil {
+			t.Fatalf("%s %v: %v", c.version, c.src, err)
+		}
+		if remote.String() != c.src.String() || local.String() != c.dst.String() {
+			t.Fatalf("%s: got %v %v, want %v %v", c.version, remote, local, c.src, c.dst)
+		}
+		rest, _ := ioutil.ReadAll(br)
+		if string(rest) != "GET / HTTP/1.1\r\n" {
+			t.Fatalf("%s: request consumed: %q", c.version, rest)
+		}
+	}
+
+	// UNKNOWN/LOCAL 使用真实连接地址
+	for _, version := range []string{client.ProxyProtocolV1, client.ProxyProtocolV2} {
+		var b bytes.Buffer
+		client.WriteProxyHeader(&b, version, nil, nil)
+		remote, _, err := readProxyHeader(bufio.NewReader(&b))
+		if err != nil || remote != nil {
+			t.Fatalf("%s unknown: %v %v", version, remote, err)
+		}
+	}
+
+	if _, _, err := readProxyHeader(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))); err == nil {
+		t.Fatal("missing header accepted")
+	}
+	if _, _, err := readProxyHeader(bufio.NewReader(strings.NewReader("PROXY TCP4 1.2.3.4\r\n"))); err == nil {
+		t.Fatal("malformed v1 header accepted")
+	}
+}
+
+func TestProxyListenerTrusted(t *testing.T) {
+	l := &proxyListener{trusted: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}}
+	if !l.isTrusted(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}) {
+		t.Fatal("10.1.2.3 should be trusted")
+	}
+	if l.isTrusted(&net.TCPAddr{IP: net.ParseIP("192.168.1.1")}) {
+		t.Fatal("192.168.1.1 should not be trusted")
+	}
+	if (&proxyListener{}).isTrusted(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}) {
+		t.Fatal("empty trusted list trusts sources")
+	}
+	// unix socket来源需明确信任
+	unixAddr := &net.UnixAddr{Name: "@", Net: "unix"}
+	if l.isTrusted(unixAddr) {
+		t.Fatal("unix peer trusted implicitly")
+	}
+	trusted, unix := parseProxyTrusted([]string{"10.0.0.0/8", " UNIX "})
+	if !unix || len(trusted) != 1 || !(&proxyListener{trusted: trusted, unix: unix}).isTrusted(unixAddr) {
+		t.Fatalf("unix keyword not parsed: %v %v", trusted, unix)
+	}
+
+	// 未配置可信来源时拒绝启动
+	c, err := config.ParseConfig([]byte(`
+http:
+  servers:
+    - listen: "127.0.0.1:0"
+      proxy_protocol: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(c)
+	if err = s.Start(context.Background()); err == nil {
+		s.Close()
+		t.Fatal("proxy_protocol without trusted sources accepted")
+	}
+
+	// unix socket监听只配置IP来源时没有可信的连接
+	dir, err := ioutil.TempDir("", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for trusted, valid := range map[string]bool{`["10.0.0.0/8"]`: false, `["unix"]`: true} {
+		c, err = config.ParseConfig([]byte(`
+http:
+  servers:
+    - listen: "unix:` + filepath.Join(dir, "proxy.sock") + `"
+      proxy_protocol: true
+      proxy_protocol_trusted: ` + trusted + `
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s = NewServer(c)
+		err = s.Start(context.Background())
+		if err == nil {
+			s.Close()
+		}
+		if (err == nil) != valid {
+			t.Errorf("unix listener trusted %s: %v", trusted, err)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package http
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenReusePort 以SO_REUSEPORT创建监听,多个worker进程绑定同一地址由内核分配连接
+func listenReusePort(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			e := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if e != nil {
+				return e
+			}
+			return err
+		},
+	}
+	return lc.Listen(context.Background(), network, addr)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package http
+
+import (
+	"errors"
+	"net"
+)
+
+// listenReusePort 当前平台不支持多进程模式
+func listenReusePort(network, addr string) (net.Listener, error) {
+	return nil, errors.New("workers mode requires SO_REUSEPORT, only supported on linux")
+}
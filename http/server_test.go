@@ -0,0 +1,226 @@
+package http
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ztgoto/webrouting/config"
+)
+
+func startTestServer(t *testing.T, yaml string) *Server {
+	c, err := config.ParseConfig([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(c)
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func getBody(t *testing.T, url string) string {
+	status, body, err := fasthttp.GetTimeout(nil, url, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != fasthttp.StatusOK {
+		t.Fatalf("%s status %d", url, status)
+	}
+	return string(body)
+}
+
+// dialFails 新建连接请求失败时返回true,不复用keep-alive连接
+func dialFails(url string) bool {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(url)
+	req.SetConnectionClose()
+	return (&fasthttp.Client{}).DoTimeout(req, &fasthttp.Response{}, time.Second) != nil
+}
+
+func TestServerInstances(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("static"), 0644)
+
+	// 两个实例互不影响:backend 提供静态文件,front 反向代理到 backend
+	backend := startTestServer(t, `
+http:
+  servers:
+    - listen: "127.0.0.1:0"
+      hosts:
+        - host: 127.0.0.1
+          locations:
+            - pattern: "/"
+              root: "`+dir+`"
+              index: index.html
+`)
+	backendAddr := backend.Addrs()["127.0.0.1:0"].String()
+
+	frontConfig := `
+upstreams:
+  - id: backend
+    servers: ["` + backendAddr + `"]
+http:
+  servers:
+    - listen: "127.0.0.1:0"
+      hosts:
+        - host: 127.0.0.1
+          locations:
+            - pattern: "/"
+              upstream: backend
+              request: {"Host": "127.0.0.1"}
+`
+	ctx, cancel := context.WithCancel(context.Background())
+	fc, err := config.ParseConfig([]byte(frontConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := NewServer(fc)
+	if err = front.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	frontAddr := front.Addrs()["127.0.0.1:0"].String()
+
+	if got := getBody(t, "http://"+frontAddr+"/"); got != "static" {
+		t.Errorf("proxied body = %q", got)
+	}
+
+	// 重新加载只影响front
+	rc, err := config.ParseConfig([]byte(frontConfig + `              response: {"X-Reloaded": "1"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = front.Reload(rc); err != nil {
+		t.Fatal(err)
+	}
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI("http://" + frontAddr + "/")
+	if err = fasthttp.DoTimeout(req, resp, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Header.Peek("X-Reloaded")) != "1" {
+		t.Error("reloaded config not applied")
+	}
+	if got := getBody(t, "http://"+backendAddr+"/"); got != "static" {
+		t.Errorf("backend body = %q", got)
+	}
+
+	// ctx 结束时front关闭,backend继续服务
+	cancel()
+	front.Wait()
+	if !dialFails("http://" + frontAddr + "/") {
+		t.Error("front still serving after ctx canceled")
+	}
+	if got := getBody(t, "http://"+backendAddr+"/"); got != "static" {
+		t.Errorf("backend body after front shutdown = %q", got)
+	}
+
+	sctx, scancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer scancel()
+	if err = backend.Shutdown(sctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("static"), 0644)
+
+	// 配置错误在启动时返回,而不是在请求时panic
+	for name, upstream := range map[string]string{
+		"bad proxy_protocol": `{id: backend, servers: ["127.0.0.1:8080"], proxy_protocol: v9}`,
+		"missing tls ca":     `{id: backend, servers: ["127.0.0.1:8080"], tls: {enable: true, ca: "` + dir + `/missing.pem"}}`,
+		"missing file":       `{id: backend, file: "` + dir + `/missing.json"}`,
+		"unknown upstream":   `{id: other, servers: ["127.0.0.1:8080"]}`,
+	} {
+		c, err := config.ParseConfig([]byte(`
+upstreams:
+  - ` + upstream + `
+http:
+  servers:
+    - listen: "127.0.0.1:0"
+      hosts:
+        - host: 127.0.0.1
+          locations:
+            - pattern: "/"
+              upstream: backend
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewServer(c)
+		if err = s.Start(context.Background()); err == nil {
+			s.Close()
+			t.Errorf("%s: start succeeded", name)
+		}
+	}
+
+	// 重新加载失败时返回错误并保留当前路由
+	zone := `
+      interceptors:
+        - name: rate_limit
+          args: {zone: "api", rate: "1r/m"}
+      hosts:
+        - host: 127.0.0.1
+          locations:
+            - pattern: "/"
+              root: "` + dir + `"
+              index: index.html
+`
+	s := startTestServer(t, `
+http:
+  servers:
+    - listen: "127.0.0.1:0"`+zone)
+	defer s.Close()
+	url := "http://" + s.Addrs()["127.0.0.1:0"].String() + "/"
+	rc, err := config.ParseConfig([]byte(`
+http:
+  servers:
+    - listen: "127.0.0.1:0"
+      hosts:
+        - host: 127.0.0.1
+          locations:
+            - pattern: "/"
+              upstream: missing
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Reload(rc); err == nil {
+		t.Error("reload accepted unknown upstream")
+	}
+	if got := getBody(t, url); got != "static" {
+		t.Errorf("routes after failed reload = %q", got)
+	}
+	if status, _, _ := fasthttp.GetTimeout(nil, url, 5*time.Second); status != fasthttp.StatusTooManyRequests {
+		t.Errorf("rate limit zone not kept after failed reload: %d", status)
+	}
+
+	// 同名限流区域不在实例之间共享计数
+	other := startTestServer(t, `
+http:
+  servers:
+    - listen: "127.0.0.1:0"`+zone)
+	defer other.Close()
+	if got := getBody(t, "http://"+other.Addrs()["127.0.0.1:0"].String()+"/"); got != "static" {
+		t.Errorf("second instance body = %q", got)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package http
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// umaskLock umask为进程级设置,修改期间互斥
+var umaskLock sync.Mutex
+
+// listenUnix 以仅属主可访问的权限创建socket文件,由 setSocketPerm 设置最终权限,
+// 避免创建后到设置权限之前被其他用户连接;修改umask期间其他goroutine新建的文件同样受影响
+func listenUnix(path string) (net.Listener, error) {
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
+
+// defaultSocketMode 未配置socket_mode时的权限,与按进程umask创建的socket一致
+func defaultSocketMode() os.FileMode {
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+	old := syscall.Umask(0)
+	syscall.Umask(old)
+	return os.ModePerm &^ os.FileMode(old)
+}
@@ -0,0 +1,16 @@
+package http
+
+import (
+	"net"
+	"os"
+)
+
+// listenUnix windows没有umask,socket文件权限由系统ACL控制
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
+
+// defaultSocketMode windows仅区分只读,不限制权限
+func defaultSocketMode() os.FileMode {
+	return os.ModePerm
+}
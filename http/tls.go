@@ -0,0 +1,372 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/ztgoto/webrouting/config"
+)
+
+const (
+	// 证书文件变更后等待的合并时间,证书与私钥通常先后写入
+	certReloadDelay = 500 * time.Millisecond
+
+	// 证书过期检查间隔
+	certExpiryCheckInterval = 24 * time.Hour
+)
+
+// certPair 证书文件与所属host
+type certPair struct {
+	host string
+	cert string
+	key  string
+}
+
+// certInfo 已加载证书信息
+type certInfo struct {
+	Listen   string    `json:"listen"`
+	Host     string    `json:"host,omitempty"`
+	File     string    `json:"file"`
+	Names    []string  `json:"names"`
+	NotAfter time.Time `json:"not_after"`
+	DaysLeft int       `json:"days_left"`
+	Expiring bool      `json:"expiring"`
+}
+
+// certStore 按SNI选择证书,证书文件变更时自动重新加载
+type certStore struct {
+	lock   sync.RWMutex
+	listen string
+	pairs  []certPair
+	def    *tls.Certificate
+	names  map[string]*tls.Certificate
+	infos  []certInfo
+	// warnDays 证书剩余天数少于此值时告警
+	warnDays int
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+	once    sync.Once
+}
+
+// newCertStore 加载监听的默认证书与各host证书
+func newCertStore(sc *config.ServerConfig, warnDays int) (*certStore, error) {
+	cs := &certStore{
+		warnDays: warnDays,
+		done:     make(chan struct{}),
+	}
+	cs.setPairs(sc)
+	if err := cs.load(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (cs *certStore) setPairs(sc *config.ServerConfig) {
+	pairs := make([]certPair, 0, len(sc.Hosts)+1)
+	if len(sc.Cert) > 0 || len(sc.Key) > 0 {
+		pairs = append(pairs, certPair{cert: sc.Cert, key: sc.Key})
+	}
+	for _, h := range sc.Hosts {
+		if len(h.Cert) == 0 && len(h.Key) == 0 {
+			continue
+		}
+		pairs = append(pairs, certPair{host: strings.TrimSpace(h.Host), cert: h.Cert, key: h.Key})
+	}
+	cs.lock.Lock()
+	cs.listen = sc.Listen
+	cs.pairs = pairs
+	cs.lock.Unlock()
+}
+
+// load 加载全部证书后原子替换,任一证书有误时保留当前证书
+func (cs *certStore) load() error {
+	cs.lock.RLock()
+	listen, pairs := cs.listen, cs.pairs
+	cs.lock.RUnlock()
+
+	var def *tls.Certificate
+	names := make(map[string]*tls.Certificate, len(pairs))
+	infos := make([]certInfo, 0, len(pairs))
+	for _, p := range pairs {
+		cert, err := loadCertificate(p.cert, p.key)
+		if err != nil {
+			return err
+		}
+		if def == nil {
+			def = cert
+		}
+		addCertNames(names, cert, p.host)
+		info := newCertInfo(listen, p, cert, cs.warnDays)
+		infos = append(infos, info)
+		logCertInfo(&info)
+	}
+	if def == nil {
+		return fmt.Errorf("listen:%s ssl enabled but no certificate configured", listen)
+	}
+
+	cs.lock.Lock()
+	cs.def = def
+	cs.names = names
+	cs.infos = infos
+	cs.lock.Unlock()
+	return nil
+}
+
+// reload 重新加载证书,失败时记录日志
+func (cs *certStore) reload() {
+	if err := cs.load(); err != nil {
+		log.Printf("listen:%s reload certificate error, keep current:%v\n", cs.listen, err)
+		return
+	}
+	log.Printf("listen:%s certificates reloaded\n", cs.listen)
+}
+
+// update 使用新的监听配置重新加载证书并更新监听的文件
+func (cs *certStore) update(sc *config.ServerConfig) error {
+	cs.setPairs(sc)
+	if err := cs.load(); err != nil {
+		return err
+	}
+	if cs.watcher != nil {
+		cs.addWatches()
+	}
+	return nil
+}
+
+func loadCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	// LoadX509KeyPair 会校验私钥与证书是否匹配
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate [%s]:%v", certFile, err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate [%s]:%v", certFile, err)
+	}
+	return &cert, nil
+}
+
+// addCertNames 以host及证书中的DNSNames作为索引,host优先
+func addCertNames(names map[string]*tls.Certificate, cert *tls.Certificate, host string) {
+	if len(host) > 0 {
+		names[strings.ToLower(host)] = cert
+	}
+	for _, name := range cert.Leaf.DNSNames {
+		name = strings.ToLower(name)
+		if _, ok := names[name]; !ok {
+			names[name] = cert
+		}
+	}
+}
+
+func newCertInfo(listen string, p certPair, cert *tls.Certificate, warnDays int) certInfo {
+	info := certInfo{
+		Listen:   listen,
+		Host:     p.host,
+		File:     p.cert,
+		Names:    cert.Leaf.DNSNames,
+		NotAfter: cert.Leaf.NotAfter,
+	}
+	info.refresh(warnDays)
+	return info
+}
+
+// refresh 按当前时间计算剩余天数与是否即将过期
+func (info *certInfo) refresh(warnDays int) {
+	left := time.Until(info.NotAfter)
+	info.DaysLeft = int(left.Hours() / 24)
+	info.Expiring = left < time.Duration(warnDays)*24*time.Hour
+}
+
+func certExpiryWarnDays(ac *config.ApplicationConfig) int {
+	if days := ac.CertExpiryWarnDays; days > 0 {
+		return days
+	}
+	return config.DefaultCertExpiryWarnDays
+}
+
+func logCertInfo(info *certInfo) {
+	if info.Expiring {
+		log.Printf("WARNING listen:%s certificate [%s] expires at %s, %d days left\n",
+			info.Listen, info.File, info.NotAfter.Format(time.RFC3339), info.DaysLeft)
+		return
+	}
+	log.Printf("listen:%s certificate [%s] %v expires at %s\n",
+		info.Listen, info.File, info.Names, info.NotAfter.Format(time.RFC3339))
+}
+
+// certificates 已加载证书信息,过期状态按当前时间计算
+func (cs *certStore) certificates() []certInfo {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	infos := make([]certInfo, len(cs.infos))
+	copy(infos, cs.infos)
+	for i := range infos {
+		infos[i].refresh(cs.warnDays)
+	}
+	return infos
+}
+
+// GetCertificate tls.Config.GetCertificate 实现
+// 依次匹配完整域名与通配符域名(*.example.com),都不匹配时使用默认证书
+func (cs *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if len(name) > 0 {
+		if cert, ok := cs.names[name]; ok {
+			return cert, nil
+		}
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if cert, ok := cs.names["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+	if cs.def == nil {
+		return nil, errors.New("no certificate")
+	}
+	return cs.def, nil
+}
+
+// watch 监听证书文件变更并定时检查证书过期
+func (cs *certStore) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	cs.watcher = watcher
+	cs.addWatches()
+	go cs.watchLoop()
+	return nil
+}
+
+// addWatches 监听证书所在目录,证书工具通常以重命名方式替换文件
+func (cs *certStore) addWatches() {
+	for _, dir := range cs.dirs() {
+		if err := cs.watcher.Add(dir); err != nil {
+			log.Printf("listen:%s watch certificate dir [%s] error:%v\n", cs.listen, dir, err)
+		}
+	}
+}
+
+func (cs *certStore) dirs() []string {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	set := make(map[string]bool, len(cs.pairs))
+	for _, p := range cs.pairs {
+		set[filepath.Dir(filepath.Clean(p.cert))] = true
+		set[filepath.Dir(filepath.Clean(p.key))] = true
+	}
+	dirs := make([]string, 0, len(set))
+	for k := range set {
+		dirs = append(dirs, k)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+func (cs *certStore) isCertFile(name string) bool {
+	name = filepath.Clean(name)
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	for _, p := range cs.pairs {
+		if name == filepath.Clean(p.cert) || name == filepath.Clean(p.key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cs *certStore) watchLoop() {
+	expiry := time.NewTicker(certExpiryCheckInterval)
+	defer expiry.Stop()
+	var timer *time.Timer
+	var fire <-chan time.Time
+	for {
+		select {
+		case <-cs.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case ev, ok := <-cs.watcher.Events:
+			if !ok {
+				return
+			}
+			if !cs.isCertFile(ev.Name) {
+				continue
+			}
+			if timer == nil {
+				timer = time.NewTimer(certReloadDelay)
+			} else {
+				timer.Reset(certReloadDelay)
+			}
+			fire = timer.C
+		case err, ok := <-cs.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("listen:%s certificate watch error:%v\n", cs.listen, err)
+		case <-fire:
+			fire = nil
+			cs.reload()
+		case <-expiry.C:
+			for _, v := range cs.certificates() {
+				if v.Expiring {
+					logCertInfo(&v)
+				}
+			}
+		}
+	}
+}
+
+// Close 停止监听证书文件
+func (cs *certStore) Close() {
+	cs.once.Do(func() {
+		close(cs.done)
+		if cs.watcher != nil {
+			cs.watcher.Close()
+		}
+	})
+}
+
+// newServerTLSConfig 创建监听使用的TLS配置,stop 在监听关闭时调用
+func newServerTLSConfig(sc *config.ServerConfig, warnDays int) (cfg *tls.Config, cs *certStore, stop func(), err error) {
+	cs, err = newCertStore(sc, warnDays)
+	if err != nil {
+		return
+	}
+	cfg = &tls.Config{
+		GetCertificate: cs.GetCertificate,
+	}
+	policyStop, err := applyTLSPolicy(cfg, &sc.TLS)
+	if err != nil {
+		err = fmt.Errorf("listen:%s %v", sc.Listen, err)
+		return
+	}
+	if err = cs.watch(); err != nil {
+		if policyStop != nil {
+			policyStop()
+		}
+		return
+	}
+	stop = func() {
+		cs.Close()
+		if policyStop != nil {
+			policyStop()
+		}
+	}
+	return
+}
@@ -0,0 +1,393 @@
+package http
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ztgoto/webrouting/config"
+)
+
+const (
+	// 会话票据密钥文件检查间隔
+	ticketKeyCheckInterval = time.Minute
+
+	// envTicketSeed 多进程模式下master生成的票据密钥种子(hex),worker据此派生相同的票据密钥
+	envTicketSeed = "WEBROUTING_TICKET_SEED"
+
+	// 由种子派生的票据密钥的轮换周期
+	sharedTicketKeyPeriod = 24 * time.Hour
+)
+
+var (
+	ticketSeedOnce sync.Once
+	ticketSeed     []byte
+)
+
+var tlsVersions = map[string]uint16{
+	"tls1.0": tls.VersionTLS10,
+	"tls1.1": tls.VersionTLS11,
+	"tls1.2": tls.VersionTLS12,
+	"tls1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"x25519": tls.X25519,
+	"p256":   tls.CurveP256,
+	"p384":   tls.CurveP384,
+	"p521":   tls.CurveP521,
+}
+
+// applyTLSPolicy 将监听的TLS策略写入tls.Config,返回需在监听关闭时停止的后台任务
+func applyTLSPolicy(cfg *tls.Config, tc *config.TLSConfig) (stop func(), err error) {
+	if cfg.MinVersion, err = parseTLSVersion(tc.MinVersion); err != nil {
+		return
+	}
+	if cfg.MaxVersion, err = parseTLSVersion(tc.MaxVersion); err != nil {
+		return
+	}
+	if cfg.CipherSuites, err = parseCipherSuites(tc.CipherSuites); err != nil {
+		return
+	}
+	if cfg.CurvePreferences, err = parseCurves(tc.Curves); err != nil {
+		return
+	}
+	if cfg.NextProtos, err = parseALPN(tc.ALPN); err != nil {
+		return
+	}
+	if err = applyClientAuth(cfg, tc); err != nil {
+		return
+	}
+
+	if tc.DisableSessionTickets {
+		cfg.SessionTicketsDisabled = true
+		return
+	}
+	if tc.SessionCacheSize > 0 {
+		// 会话缓存仅在本实例有效,与共享票据密钥互斥
+		if len(tc.SessionTicketKeyFile) > 0 {
+			log.Printf("session_cache_size set, session_ticket_key_file [%s] ignored\n", tc.SessionTicketKeyFile)
+		}
+		sc := newSessionCache(tc.SessionCacheSize)
+		cfg.WrapSession = sc.wrap
+		cfg.UnwrapSession = sc.unwrap
+		return
+	}
+	if len(tc.SessionTicketKeyFile) > 0 {
+		return startTicketKeyRotation(cfg, tc.SessionTicketKeyFile)
+	}
+	// 各worker独立生成的密钥不同,SO_REUSEPORT分配到其他worker的连接无法恢复会话
+	if seed := sharedTicketSeed(); len(seed) > 0 {
+		return startSharedTicketKeys(cfg, seed), nil
+	}
+	return
+}
+
+// applyClientAuth 配置客户端证书校验
+func applyClientAuth(cfg *tls.Config, tc *config.TLSConfig) error {
+	mode := strings.ToLower(strings.TrimSpace(tc.ClientAuth))
+	switch mode {
+	case "", "none":
+		cfg.ClientAuth = tls.NoClientCert
+		return nil
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "required":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("unknown client_auth:%s", tc.ClientAuth)
+	}
+	if len(tc.ClientCA) == 0 {
+		return fmt.Errorf("client_auth %s requires client_ca", mode)
+	}
+	pem, err := ioutil.ReadFile(tc.ClientCA)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("client_ca [%s] contains no certificate", tc.ClientCA)
+	}
+	cfg.ClientCAs = pool
+	return nil
+}
+
+func parseTLSVersion(name string) (uint16, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if len(name) == 0 {
+		return 0, nil
+	}
+	v, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown tls version:%s", name)
+	}
+	return v, nil
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16, 32)
+	for _, v := range tls.CipherSuites() {
+		known[v.Name] = v.ID
+	}
+	for _, v := range tls.InsecureCipherSuites() {
+		known[v.Name] = v.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite:%s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func parseCurves(names []string) ([]tls.CurveID, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	curves := make([]tls.CurveID, 0, len(names))
+	for _, name := range names {
+		c, ok := tlsCurves[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve:%s", name)
+		}
+		curves = append(curves, c)
+	}
+	return curves, nil
+}
+
+// parseALPN 服务只实现了HTTP/1.1,协商其他协议(如h2)会导致客户端按错误的协议通信
+func parseALPN(protos []string) ([]string, error) {
+	if len(protos) == 0 {
+		return nil, nil
+	}
+	list := make([]string, 0, len(protos))
+	for _, v := range protos {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		if v != "http/1.1" {
+			return nil, fmt.Errorf("unsupported alpn protocol:%s, only http/1.1", v)
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// readTicketKeys 读取票据密钥文件,每行一个32字节密钥(hex或base64),首行用于加密
+func readTicketKeys(path string) ([][32]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][32]byte, 0, 4)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b, err := hex.DecodeString(line)
+		if err != nil {
+			b, err = base64.StdEncoding.DecodeString(line)
+		}
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("ticket key file [%s]: each key must be 32 bytes hex or base64", path)
+		}
+		var k [32]byte
+		copy(k[:], b)
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("ticket key file [%s] is empty", path)
+	}
+	return keys, nil
+}
+
+// startTicketKeyRotation 加载票据密钥并定时检查文件变更,多实例共享同一文件即可互相恢复会话
+func startTicketKeyRotation(cfg *tls.Config, path string) (func(), error) {
+	keys, err := readTicketKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SetSessionTicketKeys(keys)
+
+	var modTime time.Time
+	if fi, e := os.Stat(path); e == nil {
+		modTime = fi.ModTime()
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(ticketKeyCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fi, e := os.Stat(path)
+				if e != nil || !fi.ModTime().After(modTime) {
+					continue
+				}
+				modTime = fi.ModTime()
+				keys, e := readTicketKeys(path)
+				if e != nil {
+					log.Printf("reload ticket keys error, keep current keys:%v\n", e)
+					continue
+				}
+				cfg.SetSessionTicketKeys(keys)
+				log.Printf("ticket keys reloaded from [%s], %d keys\n", path, len(keys))
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}, nil
+}
+
+// newTicketSeed master生成票据密钥种子,通过环境变量传递给worker,仅同一用户可读取进程环境
+func newTicketSeed() (string, error) {
+	seed := make([]byte, 32)
+	if _, err := rand.Read(seed); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(seed), nil
+}
+
+// sharedTicketSeed worker读取master传递的票据密钥种子,非worker时返回nil
+func sharedTicketSeed() []byte {
+	ticketSeedOnce.Do(func() {
+		if !isWorker() {
+			return
+		}
+		if v := os.Getenv(envTicketSeed); len(v) > 0 {
+			seed, err := hex.DecodeString(v)
+			if err != nil {
+				log.Printf("invalid %s, session tickets not shared:%v\n", envTicketSeed, err)
+				return
+			}
+			ticketSeed = seed
+		}
+	})
+	return ticketSeed
+}
+
+// sharedTicketKeys 由种子按周期派生票据密钥,首个密钥用于加密,上一周期的密钥用于解密已签发的票据
+func sharedTicketKeys(seed []byte, now time.Time) [][32]byte {
+	period := now.Unix() / int64(sharedTicketKeyPeriod/time.Second)
+	keys := make([][32]byte, 2)
+	for i := range keys {
+		mac := hmac.New(sha256.New, seed)
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(period-int64(i)))
+		mac.Write(b)
+		copy(keys[i][:], mac.Sum(nil))
+	}
+	return keys
+}
+
+// startSharedTicketKeys 使用由种子派生的票据密钥并按周期轮换,同一master下的worker密钥一致
+func startSharedTicketKeys(cfg *tls.Config, seed []byte) func() {
+	keys := sharedTicketKeys(seed, time.Now())
+	cfg.SetSessionTicketKeys(keys)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(ticketKeyCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if next := sharedTicketKeys(seed, now); next[0] != keys[0] {
+					keys = next
+					cfg.SetSessionTicketKeys(keys)
+					log.Println("shared ticket keys rotated")
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+// sessionCache 服务端会话缓存,票据仅为随机ID,会话状态保存在本地
+type sessionCache struct {
+	lock  sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type sessionEntry struct {
+	id    string
+	state []byte
+}
+
+func newSessionCache(size int) *sessionCache {
+	return &sessionCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element, size),
+	}
+}
+
+func (sc *sessionCache) wrap(cs tls.ConnectionState, ss *tls.SessionState) ([]byte, error) {
+	state, err := ss.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 32)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.items[string(id)] = sc.ll.PushFront(&sessionEntry{id: string(id), state: state})
+	for sc.ll.Len() > sc.size {
+		e := sc.ll.Back()
+		sc.ll.Remove(e)
+		delete(sc.items, e.Value.(*sessionEntry).id)
+	}
+	return id, nil
+}
+
+func (sc *sessionCache) unwrap(identity []byte, cs tls.ConnectionState) (*tls.SessionState, error) {
+	sc.lock.Lock()
+	e, ok := sc.items[string(identity)]
+	if ok {
+		sc.ll.MoveToFront(e)
+	}
+	sc.lock.Unlock()
+	if !ok {
+		// 返回nil表示不恢复会话,进行完整握手
+		return nil, nil
+	}
+	return tls.ParseSessionState(e.Value.(*sessionEntry).state)
+}
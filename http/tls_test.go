@@ -0,0 +1,200 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ztgoto/webrouting/config"
+)
+
+// writeTestCert 生成自签名证书,返回证书与私钥文件路径
+func writeTestCert(t *testing.T, dir, name string, dnsNames ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, name+".cert")
+	keyFile := filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defCert, defKey := writeTestCert(t, dir, "default", "default.test")
+	wwwCert, wwwKey := writeTestCert(t, dir, "www", "www.a.test")
+	wildCert, wildKey := writeTestCert(t, dir, "wild", "*.b.test")
+
+	cs, err := newCertStore(&config.ServerConfig{
+		Listen: ":443",
+		SSL:    true,
+		Cert:   defCert,
+		Key:    defKey,
+		Hosts: []config.HostMappingConfig{
+			{Host: "www.a.test", Cert: wwwCert, Key: wwwKey},
+			{Host: "api.b.test", Cert: wildCert, Key: wildKey},
+		},
+	}, config.DefaultCertExpiryWarnDays)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"www.a.test":   "www",
+		"api.b.test":   "wild",
+		"other.b.test": "wild",
+		"x.y.b.test":   "default",
+		"unknown.test": "default",
+		"":             "default",
+	}
+	for sni, want := range cases {
+		cert, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.Leaf.Subject.CommonName != want {
+			t.Errorf("sni:%s got %s want %s", sni, cert.Leaf.Subject.CommonName, want)
+		}
+	}
+}
+
+// leafName 默认证书的CommonName
+func leafName(t *testing.T, cs *certStore) string {
+	cert, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: "site.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "old", "site.test")
+	cs, err := newCertStore(&config.ServerConfig{Listen: ":443", SSL: true, Cert: certFile, Key: keyFile}, config.DefaultCertExpiryWarnDays)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cs.watch(); err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	// 以重命名方式替换证书与私钥,监听到变更后加载新证书
+	newCert, newKey := writeTestCert(t, dir, "new", "site.test")
+	os.Rename(newCert, certFile)
+	os.Rename(newKey, keyFile)
+	for i := 0; i < 50 && leafName(t, cs) != "new"; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := leafName(t, cs); got != "new" {
+		t.Fatalf("certificate not reloaded, got %s", got)
+	}
+
+	// 证书与私钥不匹配时保留当前证书
+	otherCert, _ := writeTestCert(t, dir, "other", "site.test")
+	os.Rename(otherCert, certFile)
+	time.Sleep(2 * certReloadDelay)
+	cs.reload()
+	if got := leafName(t, cs); got != "new" {
+		t.Errorf("bad pair replaced certificate, got %s", got)
+	}
+	ioutil.WriteFile(keyFile, []byte("broken"), 0600)
+	cs.reload()
+	if got := leafName(t, cs); got != "new" {
+		t.Errorf("broken key replaced certificate, got %s", got)
+	}
+}
+
+func TestApplyTLSPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tickets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "ticket.keys")
+	ioutil.WriteFile(keyFile, []byte("# current\n"+strings.Repeat("ab", 32)+"\n"+strings.Repeat("cd", 32)+"\n"), 0600)
+
+	cfg := &tls.Config{}
+	stop, err := applyTLSPolicy(cfg, &config.TLSConfig{
+		MinVersion:           "tls1.2",
+		CipherSuites:         []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		Curves:               []string{"X25519"},
+		SessionTicketKeyFile: keyFile,
+		ALPN:                 []string{"http/1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if cfg.MinVersion != tls.VersionTLS12 || len(cfg.CipherSuites) != 1 || cfg.CurvePreferences[0] != tls.X25519 ||
+		len(cfg.NextProtos) != 1 {
+		t.Errorf("policy not applied: %+v", cfg)
+	}
+
+	if _, err = applyTLSPolicy(&tls.Config{}, &config.TLSConfig{MinVersion: "ssl3"}); err == nil {
+		t.Error("invalid version accepted")
+	}
+	if _, err = applyTLSPolicy(&tls.Config{}, &config.TLSConfig{ALPN: []string{"h2", "http/1.1"}}); err == nil {
+		t.Error("unsupported alpn accepted")
+	}
+	ioutil.WriteFile(keyFile, []byte("short\n"), 0600)
+	if _, err = applyTLSPolicy(&tls.Config{}, &config.TLSConfig{SessionTicketKeyFile: keyFile}); err == nil {
+		t.Error("invalid ticket key accepted")
+	}
+}
+
+func TestSharedTicketKeys(t *testing.T) {
+	seed := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Now()
+	keys := sharedTicketKeys(seed, now)
+	if len(keys) != 2 || keys[0] == keys[1] || keys[0] != sharedTicketKeys(seed, now)[0] {
+		t.Fatalf("keys not derived consistently")
+	}
+	// 下一周期使用新密钥加密,仍可解密上一周期签发的票据
+	next := sharedTicketKeys(seed, now.Add(sharedTicketKeyPeriod))
+	if next[0] == keys[0] || next[1] != keys[0] {
+		t.Error("keys not rotated")
+	}
+	if sharedTicketKeys([]byte("other"), now)[0] == keys[0] {
+		t.Error("different seeds derived same key")
+	}
+}
@@ -0,0 +1,275 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ztgoto/webrouting/config"
+)
+
+const (
+	// envListeners 升级时传递给新进程的监听地址列表,顺序与文件描述符一致
+	envListeners = "WEBROUTING_LISTENERS"
+
+	// envReadyFD 新进程启动完成后写入的管道
+	envReadyFD = "WEBROUTING_READY_FD"
+
+	// 等待新进程启动完成的时间
+	upgradeReadyTimeout = 30 * time.Second
+
+	// 继承的文件描述符起始值,0-2为标准输入输出
+	listenFDStart = 3
+)
+
+var (
+	// inherited 从父进程或systemd继承且尚未使用的监听
+	inherited map[string]net.Listener
+
+	// activated systemd socket activation 传入的未命名监听,按地址匹配
+	activated []net.Listener
+
+	listenerLock sync.Mutex
+	inheritOnce  sync.Once
+)
+
+// loadInherited 读取父进程传递的监听与systemd传递的监听
+func loadInherited() {
+	inherited = make(map[string]net.Listener, 8)
+	if v := os.Getenv(envListeners); len(v) > 0 {
+		os.Unsetenv(envListeners)
+		for i, listen := range strings.Split(v, ";") {
+			ln, err := fileListener(listenFDStart+i, listen)
+			if err != nil {
+				log.Printf("inherit listen [%s] error:%v\n", listen, err)
+				continue
+			}
+			inherited[listen] = ln
+		}
+		return
+	}
+
+	// systemd socket activation, 见 sd_listen_fds(3)
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || n <= 0 {
+		return
+	}
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); len(v) > 0 {
+		names = strings.Split(v, ":")
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		ln, err := fileListener(listenFDStart+i, name)
+		if err != nil {
+			log.Printf("systemd listen fd %d error:%v\n", listenFDStart+i, err)
+			continue
+		}
+		// FileDescriptorName 可直接设置为监听地址,否则按地址匹配
+		if len(name) > 0 && name != "unknown" {
+			inherited[name] = ln
+		} else {
+			activated = append(activated, ln)
+		}
+	}
+	log.Printf("systemd socket activation, %d listeners\n", n)
+}
+
+func fileListener(fd int, name string) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), name)
+	if f == nil {
+		return nil, fmt.Errorf("invalid fd %d", fd)
+	}
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// takeInherited 获取与监听地址对应的继承监听
+func takeInherited(listen string) net.Listener {
+	inheritOnce.Do(loadInherited)
+	listenerLock.Lock()
+	defer listenerLock.Unlock()
+	if ln, ok := inherited[listen]; ok {
+		delete(inherited, listen)
+		return ln
+	}
+	if ln, ok := inherited[strings.TrimSpace(listen)]; ok {
+		delete(inherited, strings.TrimSpace(listen))
+		return ln
+	}
+	for i, ln := range activated {
+		if matchListen(listen, ln.Addr()) {
+			activated = append(activated[:i], activated[i+1:]...)
+			return ln
+		}
+	}
+	return nil
+}
+
+// matchListen 监听地址是否与已有监听一致,未指定IP的地址匹配任意通配地址
+func matchListen(listen string, la net.Addr) bool {
+	network, addr := parseListen(listen)
+	if network == "unix" {
+		return la.Network() == "unix" && la.String() == addr
+	}
+	ta, ok := la.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != strconv.Itoa(ta.Port) {
+		return false
+	}
+	if len(host) == 0 {
+		return ta.IP.IsUnspecified()
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.Equal(ta.IP)
+}
+
+// closeInherited 关闭配置中已不存在的继承监听
+func closeInherited() {
+	listenerLock.Lock()
+	defer listenerLock.Unlock()
+	for listen, ln := range inherited {
+		log.Printf("inherited listen [%s] not configured, closed\n", listen)
+		ln.Close()
+	}
+	inherited = map[string]net.Listener{}
+	for _, ln := range activated {
+		log.Printf("systemd listen [%s] not configured, closed\n", ln.Addr())
+		ln.Close()
+	}
+	activated = nil
+}
+
+// notifyReady 由升级或master启动的进程在监听全部启动后通知父进程
+func notifyReady(adminAddr string) {
+	v := os.Getenv(envReadyFD)
+	if len(v) == 0 {
+		return
+	}
+	os.Unsetenv(envReadyFD)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	if f == nil {
+		return
+	}
+	// 写入worker的管理接口地址,未启用时为空行
+	f.Write([]byte(adminAddr + "\n"))
+	f.Close()
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Upgrade 启动新的可执行文件并传递服务的全部监听,新进程启动完成后返回
+// 返回nil时当前进程应停止接收连接并在处理完进行中的请求后退出
+func (s *Server) Upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	listens := make([]string, 0, len(s.raw))
+	files := make([]*os.File, 0, len(s.raw)+1)
+	for listen, ln := range s.raw {
+		fl, ok := ln.(filer)
+		if !ok {
+			continue
+		}
+		f, e := fl.File()
+		if e != nil {
+			err = fmt.Errorf("listen [%s]:%v", listen, e)
+			break
+		}
+		listens = append(listens, listen)
+		files = append(files, f)
+	}
+	s.lock.Unlock()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		envListeners+"="+strings.Join(listens, ";"),
+		envReadyFD+"="+strconv.Itoa(listenFDStart+len(listens)))
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	// 父进程不再持有写端,新进程退出时读取返回EOF
+	w.Close()
+	log.Printf("upgrade: new process pid %d started\n", cmd.Process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, e := r.Read(b)
+		ready <- e
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeReadyTimeout):
+		err = errors.New("timeout")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process not ready:%v", err)
+	}
+	go cmd.Wait()
+
+	// 新进程已接管unix socket文件,关闭时不能删除
+	s.lock.Lock()
+	for _, ln := range s.raw {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	s.lock.Unlock()
+	return nil
+}
+
+// drainTimeout 平滑关闭时等待进行中请求的最长时间
+func drainTimeout(ac *config.ApplicationConfig) time.Duration {
+	if v := ac.UpgradeDrainTimeout; v > 0 {
+		return time.Duration(v) * time.Millisecond
+	}
+	return time.Duration(config.DefaultUpgradeDrainTimeout) * time.Millisecond
+}
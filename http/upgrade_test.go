@@ -0,0 +1,35 @@
+package http
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMatchListen(t *testing.T) {
+	any4 := &net.TCPAddr{IP: net.IPv4zero, Port: 80}
+	any6 := &net.TCPAddr{IP: net.IPv6unspecified, Port: 80}
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 80}
+	unix := &net.UnixAddr{Name: "/run/webrouting.sock", Net: "unix"}
+
+	cases := []struct {
+		listen string
+		addr   net.Addr
+		want   bool
+	}{
+		{":80", any4, true},
+		{":80", any6, true},
+		{":81", any6, false},
+		{"tcp4:0.0.0.0:80", any4, true},
+		{"127.0.0.1:80", local, true},
+		{"127.0.0.1:80", any4, false},
+		{":80", local, false},
+		{"unix:/run/webrouting.sock", unix, true},
+		{"unix:/run/other.sock", unix, false},
+		{":80", unix, false},
+	}
+	for _, c := range cases {
+		if got := matchListen(c.listen, c.addr); got != c.want {
+			t.Errorf("matchListen(%q, %v) = %v, want %v", c.listen, c.addr, got, c.want)
+		}
+	}
+}